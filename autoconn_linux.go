@@ -0,0 +1,230 @@
+// +build linux
+
+package tcpraw
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaults of RetryPolicy
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+// RetryPolicy controls how AutoConn re-dials, zero values take the defaults.
+type RetryPolicy struct {
+	MinBackoff time.Duration // wait before the first re-dial, 100ms by default
+	MaxBackoff time.Duration // cap of the doubling wait, 10s by default
+	MaxRetries int           // consecutive failed dials before giving up, 0 for unlimited
+}
+
+// backoff returns the wait before the attempt-th re-dial, counting from 0
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	min, max := p.MinBackoff, p.MaxBackoff
+	if min <= 0 {
+		min = defaultMinBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// AutoConn is a dialed connection which re-dials the remote address with
+// backoff when the flow fails fatally, i.e. the peer sent RST or FIN, or the
+// injection failed with a non-retryable error such as a vanished interface.
+// It implements net.Conn, the datagram boundaries of TCPConn are preserved.
+type AutoConn struct {
+	network string
+	address string
+	policy  RetryPolicy
+
+	mu   sync.Mutex
+	conn *TCPConn
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// DialAuto dials address like Dial, and returns a connection re-dialing it
+// under policy whenever the flow fails.
+func DialAuto(network, address string, policy RetryPolicy) (*AutoConn, error) {
+	conn, err := Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// RST and FIN are delivered to end a blocking Read
+	conn.SetDeliverControl(true)
+
+	a := new(AutoConn)
+	a.network = network
+	a.address = address
+	a.policy = policy
+	a.conn = conn
+	a.die = make(chan struct{})
+	return a, nil
+}
+
+// current returns the connection in use
+func (a *AutoConn) current() *TCPConn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conn
+}
+
+// redial replaces old with a new connection, unless it has been replaced
+// already by a concurrent caller. The lock isn't held while waiting and
+// dialing, so the deadlines can be set and Close can proceed meanwhile.
+func (a *AutoConn) redial(old *TCPConn) error {
+	if a.current() != old {
+		return nil
+	}
+	old.Close()
+
+	for attempt := 0; a.policy.MaxRetries == 0 || attempt < a.policy.MaxRetries; attempt++ {
+		select {
+		case <-time.After(a.policy.backoff(attempt)):
+		case <-a.die:
+			return ErrClosed
+		}
+
+		conn, err := Dial(a.network, a.address)
+		if err != nil {
+			continue
+		}
+		conn.SetDeliverControl(true)
+
+		a.mu.Lock()
+		select {
+		case <-a.die:
+			a.mu.Unlock()
+			conn.Close()
+			return ErrClosed
+		default:
+		}
+		if a.conn != old { // a concurrent caller won
+			a.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		conn.SetReadDeadline(a.readDeadline)
+		conn.SetWriteDeadline(a.writeDeadline)
+		a.conn = conn
+		a.mu.Unlock()
+		return nil
+	}
+	return errors.New("re-dial retries exhausted")
+}
+
+// fatal tells whether err ends the connection rather than a single operation
+func fatal(err error) bool {
+	if err == nil || errors.Is(err, ErrInjectRetryable) || errors.Is(err, ErrReadLimit) || err == io.ErrShortBuffer {
+		return false
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return true
+}
+
+// Read reads the next datagram from the remote address into p
+func (a *AutoConn) Read(p []byte) (n int, err error) {
+	for {
+		conn := a.current()
+		var meta RecvMeta
+		if !conn.peerClosed() {
+			n, meta, _, err = conn.ReadMsg(p)
+			if err == nil && n == 0 {
+				if meta.Flags&(FlagRST|FlagFIN) == 0 {
+					continue // other control segments
+				}
+			} else if !fatal(err) {
+				return n, err
+			}
+		}
+
+		select {
+		case <-a.die:
+			return 0, ErrClosed
+		default:
+		}
+		if err := a.redial(conn); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends p as a single datagram to the remote address. If the flow has
+// failed, p is sent once more over the re-dialed connection.
+func (a *AutoConn) Write(p []byte) (n int, err error) {
+	conn := a.current()
+	if !conn.peerClosed() {
+		n, err = conn.WriteTo(p, conn.remoteAddr())
+		if !fatal(err) {
+			return n, err
+		}
+	}
+
+	select {
+	case <-a.die:
+		return 0, ErrClosed
+	default:
+	}
+	if err := a.redial(conn); err != nil {
+		return 0, err
+	}
+	conn = a.current()
+	return conn.WriteTo(p, conn.remoteAddr())
+}
+
+// Close closes the connection and stops re-dialing
+func (a *AutoConn) Close() error {
+	a.dieOnce.Do(func() {
+		close(a.die)
+	})
+	return a.current().Close()
+}
+
+// LocalAddr returns the local address of the connection in use
+func (a *AutoConn) LocalAddr() net.Addr { return a.current().LocalAddr() }
+
+// RemoteAddr returns the remote address of the connection in use
+func (a *AutoConn) RemoteAddr() net.Addr { return a.current().remoteAddr() }
+
+// SetDeadline sets the read and write deadlines, they're kept across re-dials
+func (a *AutoConn) SetDeadline(t time.Time) error {
+	a.SetReadDeadline(t)
+	return a.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline, it's kept across re-dials
+func (a *AutoConn) SetReadDeadline(t time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.readDeadline = t
+	return a.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline, it's kept across re-dials
+func (a *AutoConn) SetWriteDeadline(t time.Time) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.writeDeadline = t
+	return a.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,31 @@
+//go:build linux && go1.18
+// +build linux,go1.18
+
+package tcpraw
+
+import (
+	"testing"
+)
+
+func FuzzParseCaptured(f *testing.F) {
+	// 10.0.0.2:443 -> 10.0.0.1:4000 PSH|ACK carrying "abc", and the bare TCP header
+	v4 := []byte{0x45, 0, 0, 43, 0, 0, 0x40, 0, 64, 6, 0, 0, 10, 0, 0, 2, 10, 0, 0, 1,
+		0x01, 0xbb, 0x0f, 0xa0, 0, 0, 0, 1, 0, 0, 0, 2, 0x50, 0x18, 0xff, 0xff, 0, 0, 0, 0,
+		'a', 'b', 'c'}
+	f.Add(v4, true)
+	f.Add(v4[20:], false)
+	f.Add([]byte{}, true)
+
+	f.Fuzz(func(t *testing.T, b []byte, v4 bool) {
+		tcp, ip4, ok := parseCaptured(b, v4)
+		if !ok {
+			return
+		}
+		if tcp == nil || (ip4 != nil) != v4 {
+			t.Fatalf("inconsistent result %v %v for v4 %v", tcp, ip4, v4)
+		}
+		if len(tcp.Payload) > len(b) {
+			t.Fatalf("payload of %v bytes from %v bytes", len(tcp.Payload), len(b))
+		}
+	})
+}
@@ -0,0 +1,144 @@
+// +build linux
+
+package tcpraw
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// ICMP types of the errors reported to the ICMP handler
+const (
+	icmpv4Unreachable  = 3
+	icmpv4TimeExceeded = 11
+	icmpv4FragNeeded   = 4 // code of icmpv4Unreachable
+	icmpv6Unreachable  = 1
+	icmpv6PacketTooBig = 2
+	icmpv6TimeExceeded = 3
+)
+
+// ICMPError is an ICMP error message referring to a segment sent from the
+// local port of a connection.
+type ICMPError struct {
+	Type uint8    // ICMP or ICMPv6 type
+	Code uint8    // ICMP or ICMPv6 code
+	MTU  int      // next-hop MTU of fragmentation needed or packet too big, 0 otherwise
+	From net.IP   // the router or host reporting the error
+	Addr net.Addr // the destination of the segment which triggered the error
+}
+
+// SetICMPHandler captures the ICMP errors, like destination unreachable,
+// fragmentation needed or packet too big, and time exceeded, which refer to
+// segments sent from the local port of this connection, and hands them to h.
+// h is called from the capturing goroutine, it must not block. A nil h stops
+// reporting, the ICMP sockets are kept open until the connection is closed.
+// If they can't be opened, the error is returned and the next call retries.
+func (conn *TCPConn) SetICMPHandler(h func(ICMPError)) error {
+	conn.icmpHandler.Store(h)
+	if h == nil {
+		return nil
+	}
+
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	select {
+	case <-conn.die:
+		return ErrClosed
+	default:
+	}
+	if len(conn.icmpHandles) > 0 {
+		return nil
+	}
+
+	for k := range conn.handles {
+		ip := conn.handles[k].LocalAddr().(*net.IPAddr)
+		network := "ip4:icmp"
+		if ip.IP.To4() == nil {
+			network = "ip6:ipv6-icmp"
+		}
+		handle, err := net.ListenIP(network, ip)
+		if err != nil {
+			// the next call tries again from scratch
+			for _, h := range conn.icmpHandles {
+				h.Close()
+			}
+			conn.icmpHandles = nil
+			return err
+		}
+		conn.icmpHandles = append(conn.icmpHandles, handle)
+		go conn.captureICMP(handle)
+	}
+	return nil
+}
+
+// captureICMP reads ICMP messages from handle and reports the errors
+// referring to this connection.
+func (conn *TCPConn) captureICMP(handle *net.IPConn) {
+	buf := make([]byte, maxPacketSize)
+	v4 := handle.LocalAddr().(*net.IPAddr).IP.To4() != nil
+	for {
+		// the IPv4 header is stripped by ReadFrom
+		n, from, err := handle.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		e, port, ok := parseICMPError(buf[:n], v4)
+		if !ok || port != conn.localPort() {
+			continue
+		}
+		if h, _ := conn.icmpHandler.Load().(func(ICMPError)); h != nil {
+			e.From = from.(*net.IPAddr).IP
+			h(e)
+		}
+	}
+}
+
+// parseICMPError parses an ICMP or ICMPv6 error message carrying a TCP
+// segment, and returns it along with the source port of the segment.
+func parseICMPError(b []byte, v4 bool) (e ICMPError, port int, ok bool) {
+	if len(b) < 8 {
+		return e, 0, false
+	}
+	e.Type, e.Code = b[0], b[1]
+	inner := b[8:]
+
+	var tcp []byte
+	var dst net.IP
+	if v4 {
+		switch e.Type {
+		case icmpv4Unreachable:
+			if e.Code == icmpv4FragNeeded {
+				e.MTU = int(binary.BigEndian.Uint16(b[6:]))
+			}
+		case icmpv4TimeExceeded:
+		default:
+			return e, 0, false
+		}
+		if len(inner) < 20 || inner[9] != 6 { // the quoted packet must be TCP
+			return e, 0, false
+		}
+		ihl := int(inner[0]&0x0f) * 4
+		if ihl < 20 || len(inner) < ihl+4 {
+			return e, 0, false
+		}
+		dst = net.IP(append([]byte(nil), inner[16:20]...))
+		tcp = inner[ihl:]
+	} else {
+		switch e.Type {
+		case icmpv6PacketTooBig:
+			e.MTU = int(binary.BigEndian.Uint32(b[4:]))
+		case icmpv6Unreachable, icmpv6TimeExceeded:
+		default:
+			return e, 0, false
+		}
+		if len(inner) < 44 || inner[6] != 6 { // the quoted packet must be TCP
+			return e, 0, false
+		}
+		dst = net.IP(append([]byte(nil), inner[24:40]...))
+		tcp = inner[40:]
+	}
+
+	e.Addr = &net.TCPAddr{IP: dst, Port: int(binary.BigEndian.Uint16(tcp[2:]))}
+	return e, int(binary.BigEndian.Uint16(tcp)), true
+}
@@ -0,0 +1,234 @@
+// +build linux
+
+package tcpraw
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// pooledConn is an idle connection kept by a Pool
+type pooledConn struct {
+	conn *TCPConn
+	ts   time.Time // when it was put back
+}
+
+// Pool caches dialed connections by remote address and hands them out again,
+// to amortize the cost of Dial for clients connecting repeatedly to the same
+// servers. Idle connections are health checked on Get and evicted after the
+// idle timeout. It's safe for concurrent use.
+type Pool struct {
+	network     string
+	maxIdle     int
+	idleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   map[string][]pooledConn // by the address passed to Get, most recent last
+	count  int                     // idle connections in all addresses
+	keys   map[*TCPConn]string     // the address of every connection handed out
+	closed bool
+
+	die chan struct{} // stops the sweeper
+}
+
+// NewPool creates a pool dialing network, keeping at most maxIdle idle
+// connections in total, each for at most idleTimeout, 0 for no timeout.
+func NewPool(network string, maxIdle int, idleTimeout time.Duration) *Pool {
+	p := new(Pool)
+	p.network = network
+	p.maxIdle = maxIdle
+	p.idleTimeout = idleTimeout
+	p.idle = make(map[string][]pooledConn)
+	p.keys = make(map[*TCPConn]string)
+	p.die = make(chan struct{})
+	if idleTimeout > 0 {
+		go p.sweeper()
+	}
+	return p
+}
+
+// sweeper evicts the expired connections periodically, so they're closed
+// without waiting for a Get.
+func (p *Pool) sweeper() {
+	ticker := time.NewTicker(p.idleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			expired := p.evict()
+			p.mu.Unlock()
+			closeAll(expired)
+		case <-p.die:
+			return
+		}
+	}
+}
+
+// Get returns a healthy idle connection to address, or dials a new one
+func (p *Pool) Get(address string) (*TCPConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrClosed
+	}
+	stale := p.evict()
+	for conns := p.idle[address]; len(conns) > 0; conns = p.idle[address] {
+		pc := conns[len(conns)-1]
+		p.idle[address] = conns[:len(conns)-1]
+		p.count--
+		if healthy(pc.conn) {
+			p.keys[pc.conn] = address
+			p.mu.Unlock()
+			closeAll(stale)
+			return pc.conn, nil
+		}
+		stale = append(stale, pc.conn)
+	}
+	p.mu.Unlock()
+	closeAll(stale)
+
+	conn, err := Dial(p.network, address)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.keys[conn] = address
+	p.mu.Unlock()
+	return conn, nil
+}
+
+// Put returns conn from Get to the pool, it's closed instead if it's not
+// healthy, the pool is full or closed. The datagrams queued for reading are
+// discarded, and the tunables are reset, so the next user gets it as dialed.
+// A connection with a write queue, a BPF program, subscribers or changed ports
+// can't be reset and is closed.
+func (p *Pool) Put(conn *TCPConn) error {
+	p.mu.Lock()
+	address, ok := p.keys[conn]
+	delete(p.keys, conn)
+	p.mu.Unlock()
+	if !ok {
+		return errors.New("connection not from the pool")
+	}
+
+	if !healthy(conn) || !resettable(conn) || reset(conn) != nil {
+		return conn.Close()
+	}
+
+	p.mu.Lock()
+	if p.closed || p.count >= p.maxIdle {
+		p.mu.Unlock()
+		return conn.Close()
+	}
+	p.idle[address] = append(p.idle[address], pooledConn{conn, time.Now()})
+	p.count++
+	p.mu.Unlock()
+	return nil
+}
+
+// Close closes the idle connections, the ones handed out are closed when
+// they're put back.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.die)
+	var idle []*TCPConn
+	for address, conns := range p.idle {
+		for _, pc := range conns {
+			idle = append(idle, pc.conn)
+		}
+		delete(p.idle, address)
+	}
+	p.count = 0
+	p.mu.Unlock()
+
+	closeAll(idle)
+	return nil
+}
+
+// evict removes the connections idle for longer than the timeout and returns
+// them to be closed once p.mu, which must be held, is released.
+func (p *Pool) evict() (expired []*TCPConn) {
+	if p.idleTimeout <= 0 {
+		return nil
+	}
+	for address, conns := range p.idle {
+		// the oldest ones come first
+		var n int
+		for n < len(conns) && time.Since(conns[n].ts) > p.idleTimeout {
+			expired = append(expired, conns[n].conn)
+			n++
+		}
+		if n == len(conns) {
+			delete(p.idle, address)
+		} else if n > 0 {
+			p.idle[address] = conns[n:]
+		}
+		p.count -= n
+	}
+	return expired
+}
+
+// closeAll closes conns, it's called without p.mu held as Close blocks
+func closeAll(conns []*TCPConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// healthy tells whether conn is usable: not closed nor shut down in either
+// direction, its interfaces are not gone and the peer hasn't sent RST or FIN.
+func healthy(conn *TCPConn) bool {
+	for _, ch := range []chan struct{}{conn.die, conn.gone, conn.readClosed, conn.writeClosed, conn.shutdown} {
+		select {
+		case <-ch:
+			return false
+		default:
+		}
+	}
+	return !conn.peerClosed()
+}
+
+// resettable tells whether conn has none of the settings which can't be
+// undone: a write queue, a BPF program, subscribers and changed ports.
+func resettable(conn *TCPConn) bool {
+	if conn.chWrite.Load() != nil || conn.filter.Load() != nil {
+		return false
+	}
+	if conn.remoteAddr().Port != conn.raddr.Port {
+		return false
+	}
+	if c := conn.client(); c != nil && conn.localPort() != c.LocalAddr().(*net.TCPAddr).Port {
+		return false
+	}
+	conn.subsLock.Lock()
+	defer conn.subsLock.Unlock()
+	return len(conn.subs) == 0
+}
+
+// reset discards the datagrams queued for reading, and restores the
+// deadlines, logger, tag and tunables of conn to the ones of a dialed
+// connection.
+func reset(conn *TCPConn) error {
+	conn.Drain()
+	conn.SetDeadline(time.Time{})
+	conn.SetLogger(nil)
+	conn.SetTag("")
+	conn.SetInspect(false)
+	conn.SetICMPHandler(nil)
+	conn.SetIPID(IPIDIncrement())
+	conn.SetSerializeOptions(gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true})
+	if err := conn.SetFlowLabel(0); err != nil {
+		return err
+	}
+	return conn.SetOptions(&Options{})
+}
@@ -3,6 +3,7 @@
 package tcpraw
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
@@ -10,58 +11,473 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+const (
+	// maxPacketSize is the largest IP packet a raw socket can deliver,
+	// the capture buffer is sized to it so jumbo frames are never truncated.
+	maxPacketSize = 65535
+
+	// defaultTTL is the TTL of outgoing IPv4 packets
+	defaultTTL = 64
+
+	// interfaceCacheTTL is how long an interface enumeration is reused
+	interfaceCacheTTL = 30 * time.Second
+
+	// interfaceCheckInterval is how often the interfaces of a connection are
+	// checked, a vanished one is noticed within this plus interfaceCacheTTL
+	interfaceCheckInterval = 10 * time.Second
+
+	// syncTimeout is how long a dialed connection waits for the capture to
+	// learn the sequence numbers of the hijacked flow
+	syncTimeout = time.Second
+
+	// fallbackDelay is how long the secondary address family waits for the
+	// primary one when racing both, the same as the net package
+	fallbackDelay = 300 * time.Millisecond
+
+	// rawQueueSize is the number of packets kept for ReadRawPacket
+	rawQueueSize = 64
+
+	// messageQueueSize is the number of datagrams queued for the readers,
+	// the capture waits for them once it's full
+	messageQueueSize = 128
+
+	// pendingSize is the number of datagrams a listener holds for a client
+	// whose kernel connection is yet to be accepted, pendingBytes bounds the
+	// payloads held for all of them, and pendingTimeout is how long they're
+	// held, a little longer than accepting takes.
+	pendingSize    = 8
+	pendingBytes   = 1 << 20
+	pendingTimeout = 250 * time.Millisecond
+
+	// defaultBufferSize is the capacity of the serialize buffers when the
+	// MTU of the interfaces is unknown
+	defaultBufferSize = 1500
+
+	// ipv6HDRINCL is the IPV6_HDRINCL socket option, missing in syscall
+	ipv6HDRINCL = 0x24
+
+	// soReusePort is the SO_REUSEPORT socket option, missing in syscall
+	soReusePort = 0xf
+
+	// TCP repair options from linux/tcp.h, missing in syscall
+	tcpRepair        = 19
+	tcpRepairQueue   = 20
+	tcpQueueSeq      = 21
+	tcpRecvQueue     = 1
+	tcpSendQueue     = 2
+	tcpRepairOffNoWP = -1
+
+	// ethtool ioctl querying the TX checksum offload, from linux/sockios.h
+	// and linux/ethtool.h
+	siocEthtool    = 0x8946
+	ethtoolGTxCsum = 0x16
+)
+
 var (
+	// ErrInjectRetryable matches (with errors.Is) the injection errors that are
+	// transient, such as ENOBUFS when the transmit queue is full.
+	ErrInjectRetryable = errors.New("retryable injection failure")
+
+	// ErrClosed is returned when writing to a closed connection
+	ErrClosed = errors.New("use of closed connection")
+
+	// ErrReadLimit is returned along with a datagram truncated by SetReadLimit
+	ErrReadLimit = errors.New("payload exceeds read limit")
+
+	// ErrReadOnly is returned when writing to a connection from DialReadOnly
+	ErrReadOnly = errors.New("write on read-only connection")
+
+	// ErrInterfaceGone is returned by reads and writes once the interfaces
+	// the connection captures on have disappeared or gone down, the
+	// connection has to be dialed again.
+	ErrInterfaceGone = errors.New("interface of the connection is gone")
+
+	errNoHandle         = errors.New("no handle for flow")
 	errOpNotImplemented = errors.New("operation not implemented")
-	errTimeout          = errors.New("timeout")
+	errRepairMode       = errors.New("TCP repair mode can't be left without a window probe")
+	errTTLReserved      = errors.New("TTL 1 is reserved to the kernel segments with DropKernelACKs")
+	errTimeout          = error(timeoutError{})
+	errWriteShutdown    = errors.New("write after CloseWrite")
 	expire              = time.Minute
 )
 
+// timeoutError is returned once a deadline expires, it's a net.Error
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// injectError wraps an error returned while sending a segment via raw socket
+type injectError struct {
+	err error
+}
+
+func (e *injectError) Error() string { return "inject: " + e.err.Error() }
+func (e *injectError) Unwrap() error { return e.err }
+
+// Is reports whether the error is a retryable one when matching ErrInjectRetryable
+func (e *injectError) Is(target error) bool {
+	return target == ErrInjectRetryable && isRetryable(e.err)
+}
+
+// isRetryable checks if an error from raw socket write is transient
+func isRetryable(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EAGAIN)
+}
+
+// TCPFlags is a bitmask of the control flags in a TCP header
+type TCPFlags uint8
+
+// TCP control flags
+const (
+	FlagFIN TCPFlags = 1 << iota
+	FlagSYN
+	FlagRST
+	FlagPSH
+	FlagACK
+	FlagURG
+	FlagECE
+	FlagCWR
+)
+
+// tcpFlags collects the control flags of a decoded TCP header
+func tcpFlags(tcp *layers.TCP) (flags TCPFlags) {
+	for _, f := range []struct {
+		set  bool
+		flag TCPFlags
+	}{
+		{tcp.FIN, FlagFIN}, {tcp.SYN, FlagSYN}, {tcp.RST, FlagRST}, {tcp.PSH, FlagPSH},
+		{tcp.ACK, FlagACK}, {tcp.URG, FlagURG}, {tcp.ECE, FlagECE}, {tcp.CWR, FlagCWR},
+	} {
+		if f.set {
+			flags |= f.flag
+		}
+	}
+	return flags
+}
+
+// RecvMeta carries the per-packet information of a received datagram
+type RecvMeta struct {
+	TTL   uint8    // TTL in IPv4 header, or Hop Limit in IPv6 header
+	TOS   uint8    // TOS in IPv4 header, or Traffic Class in IPv6 header
+	Flags TCPFlags // flags of the TCP segment which carried the payload
+}
+
+// SendMeta carries the per-packet settings of an outgoing datagram,
+// zero values leave the connection defaults in effect.
+type SendMeta struct {
+	TTL    int // TTL in IPv4 header, or Hop Limit in IPv6 header
+	DSCP   int // 6bit DSCP in IPv4 header, or 8bit Traffic Class in IPv6 header
+	Window int // Window in TCP header, replacing the random window
+
+	// explicit length fields, to craft malformed segments, they only take
+	// effect when FixLengths is off in SetSerializeOptions, 0 for the
+	// correct value. IPLength needs the IPv6 header to be built, i.e. a
+	// flow label set with SetFlowLabel, the kernel fills it otherwise, as
+	// it always fills IPv4 Total Length.
+	DataOffset int // Data Offset in TCP header, in 32-bit words
+	IPLength   int // Payload Length in IPv6 header
+}
+
+// tcpHeaderLen returns the length of tcp serialized with its options, padded
+// to 32-bit words.
+func tcpHeaderLen(tcp *layers.TCP) int {
+	n := 20
+	for _, o := range tcp.Options {
+		if o.OptionType == layers.TCPOptionKindEndList || o.OptionType == layers.TCPOptionKindNop {
+			n++
+		} else {
+			n += int(o.OptionLength)
+		}
+	}
+	return (n + 3) &^ 3
+}
+
+// check validates the ranges of the fields of m
+func (m SendMeta) check() error {
+	switch {
+	case m.Window > 0xffff:
+		return errors.New("window out of range")
+	case m.DataOffset < 0 || m.DataOffset > 0xf:
+		return errors.New("data offset out of range")
+	case m.IPLength < 0 || m.IPLength > 0xffff:
+		return errors.New("IP length out of range")
+	}
+	return nil
+}
+
+// checkMeta validates meta for this connection, on top of meta.check the TTL
+// marking the segments dropped by DropKernelACKs can't be used.
+func (conn *TCPConn) checkMeta(meta SendMeta) error {
+	if meta.TTL == 1 && conn.dropKernelACKs {
+		return errTTLReserved
+	}
+	return meta.check()
+}
+
+// Datagram is a payload received from the peer along with its source address
+type Datagram struct {
+	Payload   []byte
+	Addr      net.Addr
+	Meta      RecvMeta
+	Truncated bool // Payload was cut to the read limit
+}
+
+// Stages of dialing reported by DialError
+const (
+	StageResolve   = "resolve address"
+	StageRawSocket = "open raw socket"
+	StageHandshake = "dial tcp"
+	StageHijack    = "hijack tcp"
+)
+
+// DialError tells which stage of dialing failed, the underlying error is
+// available through errors.Is and errors.As.
+type DialError struct {
+	Stage string
+	Err   error
+}
+
+func (e *DialError) Error() string { return "tcpraw: " + e.Stage + ": " + e.Err.Error() }
+func (e *DialError) Unwrap() error { return e.Err }
+
+// AcceptFunc decides whether a listener accepts a new client, addr is the
+// remote address of its established kernel connection.
+type AcceptFunc func(addr net.Addr) bool
+
+// IPIDFunc generates the Identification field of outgoing IPv4 packets.
+// The kernel replaces a zero Identification with its own choice.
+type IPIDFunc func() uint16
+
+// IPIDFixed returns an IPIDFunc always generating id
+func IPIDFixed(id uint16) IPIDFunc {
+	return func() uint16 { return id }
+}
+
+// IPIDRandom returns an IPIDFunc generating a random id for every packet
+func IPIDRandom() IPIDFunc {
+	return func() (id uint16) {
+		binary.Read(rand.Reader, binary.LittleEndian, &id)
+		return id
+	}
+}
+
+// IPIDIncrement returns an IPIDFunc incrementing the id for every packet,
+// starting from a random value. It's the default strategy.
+func IPIDIncrement() IPIDFunc {
+	var id uint32
+	binary.Read(rand.Reader, binary.LittleEndian, &id)
+	return func() uint16 {
+		return uint16(atomic.AddUint32(&id, 1))
+	}
+}
+
+// iptables rules added by this package, reference counted among the
+// connections sharing one rule, like concurrent dials to the same remote.
+var (
+	rulesLock sync.Mutex
+	rulesRef  = make(map[string]int)
+)
+
+// appendRule appends rule to the OUTPUT chain of the filter table if absent,
+// it returns the handle to delete the rule with, or nil if the rule is not
+// managed by this package.
+func appendRule(proto iptables.Protocol, rule []string) *iptables.IPTables {
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil
+	}
+
+	key := fmt.Sprint(proto, rule)
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	if rulesRef[key] > 0 {
+		rulesRef[key]++
+		return ipt
+	}
+
+	if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err != nil || exists {
+		return nil
+	}
+	if err := ipt.Append("filter", "OUTPUT", rule...); err != nil {
+		return nil
+	}
+	rulesRef[key] = 1
+	return ipt
+}
+
+// deleteRule releases a reference to rule, and deletes it from the OUTPUT
+// chain when no connection uses it.
+func deleteRule(ipt *iptables.IPTables, proto iptables.Protocol, rule []string) {
+	key := fmt.Sprint(proto, rule)
+	rulesLock.Lock()
+	defer rulesLock.Unlock()
+	rulesRef[key]--
+	if rulesRef[key] <= 0 {
+		delete(rulesRef, key)
+		ipt.Delete("filter", "OUTPUT", rule...)
+	}
+}
+
 // a message from NIC
 type message struct {
-	bts  []byte
-	addr net.Addr
+	bts       []byte
+	addr      net.Addr
+	meta      RecvMeta
+	truncated bool
+}
+
+// packetHandle sends and receives TCP segments at network layer, it's
+// satisfied by the raw sockets from net.DialIP and net.ListenIP, and allows
+// an in-memory handle for loopback benchmarks.
+type packetHandle interface {
+	ReadMsgIP(b, oob []byte) (n, oobn, flags int, addr *net.IPAddr, err error)
+	WriteMsgIP(b, oob []byte, addr *net.IPAddr) (n, oobn int, err error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// Logger receives the diagnostics of a connection, like the segments ignored
+// by the capture or the failed injections. It must be safe for concurrent use.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// nopLogger is the default Logger discarding everything
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, v ...interface{}) {}
+func (nopLogger) Warnf(format string, v ...interface{})  {}
+func (nopLogger) Errorf(format string, v ...interface{}) {}
+
+// loggerHolder keeps the concrete type stored in an atomic.Value the same
+type loggerHolder struct{ Logger }
+
+// taggedLogger prefixes the messages with the tag of a connection
+type taggedLogger struct {
+	Logger
+	tag string
+}
+
+func (l taggedLogger) Debugf(format string, v ...interface{}) {
+	l.Logger.Debugf("[%s] "+format, append([]interface{}{l.tag}, v...)...)
+}
+
+func (l taggedLogger) Warnf(format string, v ...interface{}) {
+	l.Logger.Warnf("[%s] "+format, append([]interface{}{l.tag}, v...)...)
+}
+
+func (l taggedLogger) Errorf(format string, v ...interface{}) {
+	l.Logger.Errorf("[%s] "+format, append([]interface{}{l.tag}, v...)...)
 }
 
 // a tcp flow information of a connection pair
 type tcpFlow struct {
 	conn         *net.TCPConn               // the related system TCP connection of this flow
-	handle       *net.IPConn                // the handle to send packets
-	seq          uint32                     // TCP sequence number
-	ack          uint32                     // TCP acknowledge number
+	handle       packetHandle               // the handle to send packets
+	seq          uint64                     // TCP sequence number, extended to 64 bits across wraps
+	ack          uint64                     // TCP acknowledge number, extended to 64 bits across wraps
 	networkLayer gopacket.SerializableLayer // network layer header for tx
 	ts           time.Time                  // last packet incoming time
-	buf          gopacket.SerializeBuffer   // a buffer for write
 	tcpHeader    layers.TCP
+	ip4          layers.IPv4 // reused IPv4 header for tx
+	ip6          layers.IPv6 // reused IPv6 header for tx
+	window       uint16      // latest window advertised by the peer, unscaled
+	closed       bool        // RST or FIN received from the peer
+	acked        uint64      // latest acknowledge number from the peer, extended
+	pending      []message   // datagrams captured before the kernel connection is accepted
+	pendingTs    time.Time   // when the first of pending was captured
+	rejected     bool        // the kernel connection was rejected by the AcceptFunc
+
+	// TCP timestamp option from the peer
+	tsval  uint32    // latest TSval from the peer
+	tsecr  uint32    // latest TSecr from the peer
+	tsSeen time.Time // the time TSval/TSecr were received, zero if never
 }
 
 // TCPConn defines a TCP-packet oriented connection
 type TCPConn struct {
+	// 64-bit counters are kept at the head for atomic alignment on 32-bit platforms
+	dropped     uint64 // packets dropped by the kernel on all handles
+	droppedMark uint64 // value of dropped at the last successful read
+	congested   uint64 // consecutive injections rejected by the kernel for lack of buffers
+	bytesSent   uint64 // payload bytes injected
+	bytesRecv   uint64 // payload bytes delivered to readers
+
 	die     chan struct{}
 	dieOnce sync.Once
+	wg      sync.WaitGroup // discard and accept goroutines, waited by Close
+
+	// closed once the interfaces of all handles are gone
+	gone     chan struct{}
+	goneOnce sync.Once
+
+	// writers hold the read lock while sending, Close takes the write lock
+	// to wait for them before the handles are closed
+	writeLock sync.RWMutex
+
+	// half-close
+	readClosed     chan struct{}
+	readCloseOnce  sync.Once
+	writeClosed    chan struct{}
+	writeCloseOnce sync.Once
+
+	// closed by Shutdown, new writes are rejected but the queued ones are sent
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+
+	// closed once a dialed flow has learned its sequence numbers from a
+	// captured segment, usually the SYN-ACK queued during the handshake
+	synced     chan struct{}
+	syncedOnce sync.Once
 
 	// the main golang sockets
 	tcpconn  *net.TCPConn     // from net.Dial
 	listener *net.TCPListener // from net.Listen
+	accept   atomic.Value     // AcceptFunc of the listener, nil to accept all
+	raddr    *net.TCPAddr     // the remote endpoint of a dialed connection, see remoteAddr
+	lport    int32            // local TCP port, accessed atomically
+	rport    int32            // remote TCP port of a dialed connection, accessed atomically
+	readOnly bool             // from DialReadOnly, no kernel socket nor send path
 
 	// handles
 	handles []*net.IPConn
 
+	// ICMP error reporting, icmpHandles are guarded by flowsLock
+	icmpHandler atomic.Value // func(ICMPError)
+	icmpHandles []*net.IPConn
+
 	// packets captured from all related NICs will be delivered to this channel
 	chMessage chan message
+	queueHigh int32 // high-water mark of chMessage, accessed atomically
+
+	// channel based reading
+	chPackets   chan Datagram
+	packetsOnce sync.Once
+
+	// fan-out subscribers, each receives a copy of every datagram
+	subs     map[chan Datagram]struct{}
+	subsLock sync.Mutex
 
 	// all TCP flows
 	flowTable map[string]*tcpFlow
 	flowsLock sync.Mutex
+	pending   int // bytes held in the flows of a listener, guarded by flowsLock
 
 	// iptables
 	iptables *iptables.IPTables
@@ -70,12 +486,163 @@ type TCPConn struct {
 	ip6tables *iptables.IPTables
 	ip6rule   []string
 
+	ttltables      *iptables.IPTables // drops the IPv4 segments of the hijacked socket, see Dialer.DropKernelACKs
+	ttlrule        []string
+	dropKernelACKs bool
+
 	// deadlines
 	readDeadline  atomic.Value
 	writeDeadline atomic.Value
 
-	// serialization
-	opts gopacket.SerializeOptions
+	// the last remote address resolved for writing, resolvedAddr
+	lastAddr atomic.Value
+
+	// serialization, guarded by flowsLock
+	opts      gopacket.SerializeOptions
+	flowLabel uint32 // IPv6 flow label, the IPv6 handles run in IPV6_HDRINCL mode if non-zero
+
+	// number of extra attempts on retryable injection errors
+	injectRetries int32
+
+	// echo TCP timestamp option in outgoing segments if non-zero
+	echoTimestamps int32
+
+	// user supplied BPF program replacing the generated port filter
+	filter atomic.Value
+
+	// deliver segments without PSH as empty datagrams if non-zero
+	deliverControl int32
+
+	// max payload size delivered per datagram, 0 for unlimited
+	readLimit int32
+
+	// queue raw captured packets for ReadRawPacket if non-zero
+	inspect int32
+	chRaw   chan []byte
+
+	// ring of the latest captured headers for RecentEvents, see SetEventLog
+	eventLogSize int32 // accessed atomically, 0 if disabled
+	events       []Event
+	eventNext    int // index of the next event to overwrite in a full ring
+	eventsLock   sync.Mutex
+
+	// IPv4 header fields, the IPv4 handles run in IP_HDRINCL mode
+	tos  int32        // TOS byte
+	noDF int32        // clear Don't-Fragment flag if non-zero
+	ipid atomic.Value // IPIDFunc
+
+	// max random gap in sequence space before each segment, 0 for none
+	seqJitter int32
+
+	// defaults of SendMeta.TTL and SendMeta.Window, 0 for none
+	ttl    int32
+	window int32
+
+	// max bytes sent but not acknowledged per flow, 0 for unlimited
+	maxInflight uint32
+	ackNotify   chan struct{} // closed and replaced on new acknowledgements, guarded by flowsLock
+
+	// opt-in injection worker, see SetWriteQueue
+	chWrite        atomic.Value // chan writeRequest
+	queueLock      sync.RWMutex // held for reading while queueing, Shutdown waits for them
+	writeQueueOnce sync.Once
+	writeErr       error // first error of the queued writes since the last Flush
+	writeErrLock   sync.Mutex
+
+	// diagnostics, loggerHolder and the string tag prefixing its messages
+	logger atomic.Value
+	tag    atomic.Value
+
+	// serialize buffers shared by the flows, see SetBufferPool
+	bufPool     atomic.Value // *bufferPool
+	bufPoolOnce sync.Once
+}
+
+// bufferPool recycles the serialize buffers of a connection. A buffer is
+// owned by the caller of get until it's put back, which must happen only
+// once its bytes have been injected or copied.
+type bufferPool struct {
+	size int // capacity of the buffers, negative to allocate for every segment
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		// the layers are serialized back to front, all the bytes are prepended
+		return gopacket.NewSerializeBufferExpectedSize(p.size, 0)
+	}
+	return p
+}
+
+func (p *bufferPool) get() gopacket.SerializeBuffer {
+	if p.size < 0 {
+		return gopacket.NewSerializeBuffer()
+	}
+	return p.pool.Get().(gopacket.SerializeBuffer)
+}
+
+// put recycles buf, a buffer grown beyond the size is dropped so the memory
+// kept stays bounded.
+func (p *bufferPool) put(buf gopacket.SerializeBuffer) {
+	if p.size < 0 || len(buf.Bytes()) > p.size {
+		return
+	}
+	p.pool.Put(buf)
+}
+
+// newTCPConn allocates a TCPConn with all internal structures initialized
+func newTCPConn() *TCPConn {
+	conn := new(TCPConn)
+	conn.die = make(chan struct{})
+	conn.gone = make(chan struct{})
+	conn.synced = make(chan struct{})
+	conn.readClosed = make(chan struct{})
+	conn.writeClosed = make(chan struct{})
+	conn.shutdown = make(chan struct{})
+	conn.flowTable = make(map[string]*tcpFlow)
+	conn.chMessage = make(chan message, messageQueueSize)
+	conn.chRaw = make(chan []byte, rawQueueSize)
+	conn.ackNotify = make(chan struct{})
+	conn.opts = gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	conn.ipid.Store(IPIDIncrement())
+	conn.logger.Store(loggerHolder{nopLogger{}})
+	conn.tag.Store("")
+	return conn
+}
+
+// log returns the logger of the connection
+func (conn *TCPConn) log() Logger {
+	l := conn.logger.Load().(loggerHolder).Logger
+	if tag := conn.Tag(); tag != "" {
+		return taggedLogger{l, tag}
+	}
+	return l
+}
+
+// SetTag attaches tag to the connection, it prefixes every message of the
+// logger as "[tag] " to tell the connections of a pool apart.
+func (conn *TCPConn) SetTag(tag string) error {
+	conn.tag.Store(tag)
+	return nil
+}
+
+// Tag returns the tag of the connection, empty if none
+func (conn *TCPConn) Tag() string {
+	return conn.tag.Load().(string)
+}
+
+// SetLogger sets the logger receiving the diagnostics of the connection,
+// nil restores the default which discards them.
+func (conn *TCPConn) SetLogger(l Logger) error {
+	if l == nil {
+		l = nopLogger{}
+	}
+	conn.logger.Store(loggerHolder{l})
+	return nil
 }
 
 // lockflow locks the flow table and apply function `f` to the entry, and create one if not exist
@@ -86,106 +653,307 @@ func (conn *TCPConn) lockflow(addr net.Addr, f func(e *tcpFlow)) {
 	if e == nil { // entry first visit
 		e = new(tcpFlow)
 		e.ts = time.Now()
-		e.buf = gopacket.NewSerializeBuffer()
 	}
 	f(e)
 	conn.flowTable[key] = e
 	conn.flowsLock.Unlock()
 }
 
-// clean expired flows
+// cleaner removes the flows idle for longer than expire, every minute
 func (conn *TCPConn) cleaner() {
 	ticker := time.NewTicker(time.Minute)
-	select {
-	case <-conn.die:
-		return
-	case <-ticker.C:
-		conn.flowsLock.Lock()
-		for k, v := range conn.flowTable {
-			if time.Now().Sub(v.ts) > expire {
-				if v.conn != nil {
-					setTTL(v.conn, 64)
-					v.conn.Close()
+	defer ticker.Stop()
+	check := time.NewTicker(interfaceCheckInterval)
+	defer check.Stop()
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-check.C:
+			if !conn.interfacesAlive() {
+				conn.log().Errorf("interfaces of the connection are gone")
+				conn.goneOnce.Do(func() {
+					close(conn.gone)
+				})
+			}
+		case <-ticker.C:
+			conn.flowsLock.Lock()
+			for k, v := range conn.flowTable {
+				// the flow of a dialed connection lives as long as the connection
+				if conn.raddr != nil && k == conn.remoteAddr().String() {
+					continue
+				}
+				if time.Now().Sub(v.ts) > expire {
+					if v.conn != nil {
+						setTTL(v.conn, 64)
+						v.conn.Close()
+					}
+					conn.dropPending(v)
+					delete(conn.flowTable, k)
 				}
-				delete(conn.flowTable, k)
 			}
+			conn.flowsLock.Unlock()
 		}
-		conn.flowsLock.Unlock()
 	}
 }
 
+// interfacesAlive tells whether any handle is still on an interface which
+// exists and is up, the handles on unspecified addresses are always alive.
+func (conn *TCPConn) interfacesAlive() bool {
+	for k := range conn.handles {
+		ip := conn.handles[k].LocalAddr().(*net.IPAddr).IP
+		if ip.IsUnspecified() {
+			return true
+		}
+		if iface := interfaceByIP(ip); iface != nil && iface.Flags&net.FlagUp != 0 {
+			return true
+		}
+	}
+	return len(conn.handles) == 0
+}
+
 // captureFlow capture every inbound packets based on rules of BPF
-func (conn *TCPConn) captureFlow(handle *net.IPConn, port int) {
-	buf := make([]byte, 2048)
-	opt := gopacket.DecodeOptions{NoCopy: true, Lazy: true}
+func (conn *TCPConn) captureFlow(handle packetHandle) {
+	buf := make([]byte, maxPacketSize)
+	oob := make([]byte, 3*syscall.CmsgSpace(4)) // SO_RXQ_OVFL, IPV6_HOPLIMIT and IPV6_TCLASS
+	var lastDrops uint32
 	for {
-		n, addr, err := handle.ReadFromIP(buf)
+		n, oobn, _, addr, err := handle.ReadMsgIP(buf, oob)
 		if err != nil {
 			return
 		}
 
+		// accumulate the kernel drop counter delivered with SO_RXQ_OVFL
+		if drops, ok := parseDrops(oob[:oobn]); ok {
+			atomic.AddUint64(&conn.dropped, uint64(drops-lastDrops))
+			lastDrops = drops
+		}
+
 		// try decoding TCP frame from buf[:n]
-		packet := gopacket.NewPacket(buf[:n], layers.LayerTypeTCP, opt)
-		transport := packet.TransportLayer()
-		tcp, ok := transport.(*layers.TCP)
+		tcp, ip4, ok := parseCaptured(buf[:n], addr.IP.To4() != nil)
 		if !ok {
 			continue
 		}
 
 		// port filtering
-		if int(tcp.DstPort) != port {
+		if int32(tcp.DstPort) != atomic.LoadInt32(&conn.lport) {
 			continue
 		}
 
+		// hand a copy of the captured bytes to inspection, never block capture
+		if atomic.LoadInt32(&conn.inspect) != 0 {
+			raw := make([]byte, n)
+			copy(raw, buf[:n])
+			select {
+			case conn.chRaw <- raw:
+			default:
+			}
+		}
+
 		// address building
 		var src net.TCPAddr
 		src.IP = addr.IP
 		src.Port = int(tcp.SrcPort)
 
-		var orphan bool
+		// 4-tuple filtering, a dialed connection only accepts segments from
+		// its remote endpoint, so a stale flow sharing the same remote host
+		// cannot contaminate this connection during rapid reconnects.
+		if conn.raddr != nil && (int32(src.Port) != atomic.LoadInt32(&conn.rport) || !conn.raddr.IP.Equal(src.IP)) {
+			conn.log().Debugf("captured segment from %v with wrong tuple, ignoring", &src)
+			continue
+		}
+		if atomic.LoadInt32(&conn.eventLogSize) > 0 {
+			conn.logEvent(Event{time.Now(), &src, tcp.Seq, tcp.Ack, tcpFlags(tcp)})
+		}
+
+		var orphan, synced bool
 		// flow maintaince
 		conn.lockflow(&src, func(e *tcpFlow) {
-			if e.conn == nil { // make sure it's related to net.TCPConn
+			if e.conn == nil && !conn.readOnly { // make sure it's related to net.TCPConn
 				orphan = true // mark as orphan if it's not related net.TCPConn
 			}
 
 			// to keep track of TCP header related to this source
 			e.ts = time.Now()
+			e.window = tcp.Window
 			if tcp.ACK {
-				e.seq = tcp.Ack
+				e.seq = unwrapSeq(e.seq, tcp.Ack)
+				if e.seq != e.acked && atomic.LoadUint32(&conn.maxInflight) > 0 {
+					// wake up the writers waiting for the inflight window
+					close(conn.ackNotify)
+					conn.ackNotify = make(chan struct{})
+				}
+				e.acked = e.seq
 			}
 			if tcp.SYN {
-				e.ack = tcp.Seq + 1
+				e.ack = unwrapSeq(e.ack, tcp.Seq+1)
 			}
 			if tcp.PSH {
 				//if e.ack == tcp.Seq {
-					e.ack = tcp.Seq + uint32(len(tcp.Payload))
+					e.ack = unwrapSeq(e.ack, tcp.Seq+uint32(len(tcp.Payload)))
 				//}
 			}
+			if tsval, tsecr, ok := parseTimestamp(tcp); ok {
+				e.tsval, e.tsecr, e.tsSeen = tsval, tsecr, e.ts
+			}
 			if tcp.RST || tcp.FIN {
-				if(e.handle!=nil){
-					fmt.Println("recv RST | FIN ",e.conn.RemoteAddr())
+				e.closed = true
+				if e.handle != nil {
+					conn.log().Debugf("received RST or FIN from %v, flow closed", &src)
 					e.handle = nil
 				}
-			}else{
+			} else {
 				e.handle = handle
+				synced = true
 			}
 		})
+		if synced && conn.raddr != nil {
+			conn.syncedOnce.Do(func() { close(conn.synced) })
+		}
+		if orphan && conn.raddr != nil {
+			conn.log().Debugf("captured segment from %v without a kernel connection, ignoring payload", &src)
+		}
+
+		// half-closed for reading, discard payloads
+		select {
+		case <-conn.readClosed:
+			continue
+		default:
+		}
 
-		// push data if it's not orphan
-		if !orphan && tcp.PSH {
-			payload := make([]byte, len(tcp.Payload))
+		// per-packet information
+		meta := RecvMeta{Flags: tcpFlags(tcp)}
+		if ip4 != nil {
+			meta.TTL = ip4.TTL
+			meta.TOS = ip4.TOS
+		} else {
+			// the IPv6 header is stripped, the kernel attaches the fields
+			meta.TTL, _ = parseIPv6Control(oob[:oobn], syscall.IPV6_HOPLIMIT)
+			meta.TOS, _ = parseIPv6Control(oob[:oobn], syscall.IPV6_TCLASS)
+		}
+
+		// push data if it's not orphan, a zero-length payload is not data,
+		// it would be read as 0 bytes which is easily taken for EOF. A
+		// listener holds the orphan payloads, they may have overtaken the
+		// accepting of their kernel connection.
+		empty := len(tcp.Payload) == 0
+		if (!orphan || conn.raddr == nil) && tcp.PSH && !empty {
+			size := len(tcp.Payload)
+			limit := int(atomic.LoadInt32(&conn.readLimit))
+			truncated := limit > 0 && size > limit
+			if truncated {
+				size = limit
+			}
+			payload := make([]byte, size)
 			copy(payload, tcp.Payload)
-			select {
-			case conn.chMessage <- message{payload, &src}:
-			case <-conn.die:
+			if orphan && !conn.hold(message{payload, &src, meta, truncated}) {
+				continue
+			}
+			conn.broadcast(Datagram{payload, &src, meta, truncated})
+			if !conn.enqueue(message{payload, &src, meta, truncated}) {
+				return
+			}
+		} else if (!tcp.PSH || empty) && atomic.LoadInt32(&conn.deliverControl) != 0 {
+			// control segments are delivered with empty payload
+			conn.broadcast(Datagram{nil, &src, meta, false})
+			if !conn.enqueue(message{nil, &src, meta, false}) {
 				return
 			}
 		}
 	}
 }
 
+// hold keeps packet in its flow until the kernel connection is accepted, at
+// most pendingSize of them per flow and pendingBytes in all, for
+// pendingTimeout. It returns true if the connection has been accepted
+// meanwhile, and packet is to be delivered right away.
+func (conn *TCPConn) hold(packet message) (accepted bool) {
+	conn.lockflow(packet.addr, func(e *tcpFlow) {
+		if e.conn != nil {
+			accepted = true
+			return
+		} else if e.rejected {
+			return
+		}
+
+		now := time.Now()
+		if conn.pending+len(packet.bts) > pendingBytes {
+			conn.expirePending(now)
+		}
+		if len(e.pending) > 0 && now.Sub(e.pendingTs) > pendingTimeout {
+			conn.dropPending(e)
+		}
+		if len(e.pending) < pendingSize && conn.pending+len(packet.bts) <= pendingBytes {
+			if len(e.pending) == 0 {
+				e.pendingTs = now
+			}
+			e.pending = append(e.pending, packet)
+			conn.pending += len(packet.bts)
+		} else {
+			conn.log().Debugf("captured segment from %v without a kernel connection, ignoring payload", packet.addr)
+		}
+	})
+	return
+}
+
+// expirePending drops the datagrams held for longer than pendingTimeout,
+// flowsLock must be held.
+func (conn *TCPConn) expirePending(now time.Time) {
+	for _, e := range conn.flowTable {
+		if len(e.pending) > 0 && now.Sub(e.pendingTs) > pendingTimeout {
+			conn.dropPending(e)
+		}
+	}
+}
+
+// dropPending drops the datagrams held in e, flowsLock must be held
+func (conn *TCPConn) dropPending(e *tcpFlow) {
+	for _, packet := range e.pending {
+		conn.pending -= len(packet.bts)
+	}
+	e.pending = nil
+}
+
+// enqueue queues packet for the readers and tracks the high-water mark of the
+// queue, it returns false if the connection is closed meanwhile.
+func (conn *TCPConn) enqueue(packet message) bool {
+	select {
+	case conn.chMessage <- packet:
+	case <-conn.die:
+		return false
+	}
+	n := int32(len(conn.chMessage))
+	for {
+		high := atomic.LoadInt32(&conn.queueHigh)
+		if n <= high || atomic.CompareAndSwapInt32(&conn.queueHigh, high, n) {
+			return true
+		}
+	}
+}
+
+// parseCaptured decodes a packet captured on a raw socket. IPv4 raw sockets
+// deliver the IP header along with the message, IPv6 raw sockets deliver from
+// the TCP header as the kernel has walked the extension headers, so b starts
+// with the IPv4 header if v4, and ip4 is nil otherwise. A malformed packet is
+// reported by ok, the decoding never panics.
+func parseCaptured(b []byte, v4 bool) (tcp *layers.TCP, ip4 *layers.IPv4, ok bool) {
+	first := layers.LayerTypeTCP
+	if v4 {
+		first = layers.LayerTypeIPv4
+	}
+	packet := gopacket.NewPacket(b, first, gopacket.DecodeOptions{NoCopy: true, Lazy: true})
+	if tcp, ok = packet.TransportLayer().(*layers.TCP); !ok {
+		return nil, nil, false
+	}
+	ip4, _ = packet.NetworkLayer().(*layers.IPv4)
+	return tcp, ip4, true
+}
+
 // ReadFrom implements the PacketConn ReadFrom method.
+// Every call consumes a whole datagram like UDP, if p is too small, the rest
+// of the datagram is discarded and io.ErrShortBuffer is returned with n bytes.
+// Segments with empty payload are skipped unless SetDeliverControl is on, so
+// n is never 0 otherwise, the end of the connection is reported by io.EOF.
 func (conn *TCPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	var timer *time.Timer
 	var deadline <-chan time.Time
@@ -195,104 +963,1249 @@ func (conn *TCPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 		deadline = timer.C
 	}
 
-	select {
-	case <-deadline:
-		return 0, nil, errTimeout
-	case <-conn.die:
-		return 0, nil, io.EOF
-	case packet := <-conn.chMessage:
-		n = copy(p, packet.bts)
-		return n, packet.addr, nil
+	packet, err := conn.readMessage(context.Background(), deadline)
+	if err != nil {
+		return 0, nil, err
 	}
+	n, err = copyMessage(p, packet)
+	return n, packet.addr, err
 }
 
-// WriteTo implements the PacketConn WriteTo method.
-func (conn *TCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+// ReadFromTimeout acts like ReadFrom, it gives up after d for this call only,
+// the read deadline is left untouched and still applies if it's earlier.
+func (conn *TCPConn) ReadFromTimeout(p []byte, d time.Duration) (n int, addr net.Addr, err error) {
+	t := time.Now().Add(d)
+	if dl, ok := conn.readDeadline.Load().(time.Time); ok && !dl.IsZero() && dl.Before(t) {
+		t = dl
+	}
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+
+	packet, err := conn.readMessage(context.Background(), timer.C)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err = copyMessage(p, packet)
+	return n, packet.addr, err
+}
+
+// ReadFromContext acts like ReadFrom, and returns ctx.Err() once ctx is done.
+// The read deadline still applies.
+func (conn *TCPConn) ReadFromContext(ctx context.Context, p []byte) (n int, addr net.Addr, err error) {
+	var timer *time.Timer
 	var deadline <-chan time.Time
-	if d, ok := conn.writeDeadline.Load().(time.Time); ok && !d.IsZero() {
-		timer := time.NewTimer(time.Until(d))
+	if d, ok := conn.readDeadline.Load().(time.Time); ok && !d.IsZero() {
+		timer = time.NewTimer(time.Until(d))
 		defer timer.Stop()
 		deadline = timer.C
 	}
 
-	select {
-	case <-deadline:
-		return 0, errTimeout
-	case <-conn.die:
-		return 0, io.EOF
-	default:
-		raddr, err := net.ResolveTCPAddr("tcp", addr.String())
-		if err != nil {
-			return 0, err
-		}
+	packet, err := conn.readMessage(ctx, deadline)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err = copyMessage(p, packet)
+	return n, packet.addr, err
+}
 
-		var lport int
-		if conn.tcpconn != nil {
-			lport = conn.tcpconn.LocalAddr().(*net.TCPAddr).Port
-		} else {
-			lport = conn.listener.Addr().(*net.TCPAddr).Port
+// ReadMsg acts like ReadFrom, and also returns the per-packet information
+// of the segment which carried the datagram.
+func (conn *TCPConn) ReadMsg(p []byte) (n int, meta RecvMeta, addr net.Addr, err error) {
+	var timer *time.Timer
+	var deadline <-chan time.Time
+	if d, ok := conn.readDeadline.Load().(time.Time); ok && !d.IsZero() {
+		timer = time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	packet, err := conn.readMessage(context.Background(), deadline)
+	if err != nil {
+		return 0, meta, nil, err
+	}
+	n, err = copyMessage(p, packet)
+	return n, packet.meta, packet.addr, err
+}
+
+// ReadBatch reads up to len(ps) datagrams, the size and the source address of
+// the i-th datagram are stored in ns[i] and addrs[i], both must be at least as
+// long as ps. It blocks until the first datagram arrives, then collects only
+// the datagrams immediately available without waiting for the batch to fill.
+// If the read deadline fires first, it returns 0 with a timeout error. A
+// datagram cut to fit ps[i] or the read limit ends the batch with the error
+// ReadFrom would report.
+func (conn *TCPConn) ReadBatch(ps [][]byte, ns []int, addrs []net.Addr) (count int, err error) {
+	if len(ps) == 0 {
+		return 0, nil
+	}
+	if len(ns) < len(ps) || len(addrs) < len(ps) {
+		return 0, errors.New("short batch metadata slices")
+	}
+
+	var timer *time.Timer
+	var deadline <-chan time.Time
+	if d, ok := conn.readDeadline.Load().(time.Time); ok && !d.IsZero() {
+		timer = time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	packet, err := conn.readMessage(context.Background(), deadline)
+	if err != nil {
+		return 0, err
+	}
+	ns[0], err = copyMessage(ps[0], packet)
+	addrs[0] = packet.addr
+	count = 1
+	if err != nil {
+		return count, err
+	}
+
+	for count < len(ps) {
+		select {
+		case packet := <-conn.chMessage:
+			atomic.AddUint64(&conn.bytesRecv, uint64(len(packet.bts)))
+			ns[count], err = copyMessage(ps[count], packet)
+			addrs[count] = packet.addr
+			count++
+			if err != nil {
+				return count, err
+			}
+		default:
+			return count, nil
 		}
+	}
+	return count, nil
+}
+
+// copyMessage copies the payload of packet into p like a datagram read, the
+// error tells whether it was cut by the read limit or by the size of p.
+func copyMessage(p []byte, packet message) (n int, err error) {
+	n = copy(p, packet.bts)
+	if packet.truncated {
+		err = ErrReadLimit
+	} else if n < len(packet.bts) {
+		err = io.ErrShortBuffer
+	}
+	return n, err
+}
+
+// readMessage waits for the next message from capture, or returns an error
+// when ctx is done, deadline fires or the connection stops reading.
+func (conn *TCPConn) readMessage(ctx context.Context, deadline <-chan time.Time) (message, error) {
+	// the queued datagrams are not delivered once the reading side is shut
+	select {
+	case <-conn.die:
+		return message{}, io.EOF
+	case <-conn.readClosed:
+		return message{}, io.EOF
+	default:
+	}
+
+	select {
+	case <-ctx.Done():
+		return message{}, ctx.Err()
+	case <-deadline:
+		return message{}, errTimeout
+	case <-conn.die:
+		return message{}, io.EOF
+	case <-conn.readClosed:
+		return message{}, io.EOF
+	case <-conn.gone:
+		return message{}, ErrInterfaceGone
+	case packet := <-conn.chMessage:
+		atomic.StoreUint64(&conn.droppedMark, atomic.LoadUint64(&conn.dropped))
+		atomic.AddUint64(&conn.bytesRecv, uint64(len(packet.bts)))
+		return packet, nil
+	}
+}
+
+// Packets returns a channel delivering received datagrams, it's closed when
+// the connection is closed or shut down for reading. Every Payload is a fresh
+// copy owned by the receiver, like the data copied into the buffer of ReadFrom.
+// Datagrams are taken from the same queue as ReadFrom, so a datagram consumed
+// through one of them will not be seen by the other.
+func (conn *TCPConn) Packets() <-chan Datagram {
+	conn.packetsOnce.Do(func() {
+		conn.chPackets = make(chan Datagram)
+		go func() {
+			defer close(conn.chPackets)
+			for {
+				packet, err := conn.readMessage(context.Background(), nil)
+				if err != nil {
+					return
+				}
+				select {
+				case conn.chPackets <- Datagram{packet.bts, packet.addr, packet.meta, packet.truncated}:
+				case <-conn.die:
+					return
+				case <-conn.readClosed:
+					return
+				}
+			}
+		}()
+	})
+	return conn.chPackets
+}
+
+// ReadRawPacket returns the next packet captured in inspect mode, as delivered
+// by the raw socket: IPv4 packets start at the IP header, IPv6 packets start at
+// the TCP header, there's no link layer. It honors the read deadline.
+func (conn *TCPConn) ReadRawPacket() ([]byte, error) {
+	var deadline <-chan time.Time
+	if d, ok := conn.readDeadline.Load().(time.Time); ok && !d.IsZero() {
+		timer := time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-deadline:
+		return nil, errTimeout
+	case <-conn.die:
+		return nil, io.EOF
+	case raw := <-conn.chRaw:
+		return raw, nil
+	}
+}
+
+// Subscribe returns a channel receiving a copy of every datagram, including
+// the ones consumed by ReadFrom, Packets or other subscribers, and a function
+// to cancel the subscription. The channel holds up to buffer datagrams, when
+// it's full further datagrams are discarded for this subscriber only, a slow
+// subscriber never stalls the capture nor the other readers. The channel is
+// closed on cancel or when the connection is closed. A negative buffer is
+// taken as 0, a datagram is received then only if the subscriber is waiting.
+func (conn *TCPConn) Subscribe(buffer int) (<-chan Datagram, func()) {
+	if buffer < 0 {
+		buffer = 0
+	}
+	ch := make(chan Datagram, buffer)
+	conn.subsLock.Lock()
+	select {
+	case <-conn.die:
+		close(ch)
+	default:
+		if conn.subs == nil {
+			conn.subs = make(map[chan Datagram]struct{})
+		}
+		conn.subs[ch] = struct{}{}
+	}
+	conn.subsLock.Unlock()
+
+	cancel := func() {
+		conn.subsLock.Lock()
+		defer conn.subsLock.Unlock()
+		if _, ok := conn.subs[ch]; ok {
+			close(ch)
+			delete(conn.subs, ch)
+		}
+	}
+	return ch, cancel
+}
+
+// broadcast hands d to every subscriber without blocking
+func (conn *TCPConn) broadcast(d Datagram) {
+	conn.subsLock.Lock()
+	defer conn.subsLock.Unlock()
+	for ch := range conn.subs {
+		sub := d
+		if d.Payload != nil {
+			sub.Payload = make([]byte, len(d.Payload))
+			copy(sub.Payload, d.Payload)
+		}
+		select {
+		case ch <- sub:
+		default:
+		}
+	}
+}
+
+// BytesSent returns the number of payload bytes injected successfully
+func (conn *TCPConn) BytesSent() uint64 {
+	return atomic.LoadUint64(&conn.bytesSent)
+}
+
+// BytesRecv returns the number of payload bytes delivered to the readers
+func (conn *TCPConn) BytesRecv() uint64 {
+	return atomic.LoadUint64(&conn.bytesRecv)
+}
+
+// QueueStats describes the queue of datagrams waiting for the readers
+type QueueStats struct {
+	Len       int    // datagrams queued now
+	Cap       int    // capacity of the queue
+	HighWater int    // most datagrams queued at once since the connection started
+	Dropped   uint64 // packets dropped by the kernel, e.g. while the capture waits on a full queue
+}
+
+// QueueStats returns the statistics of the receive queue, to size the socket
+// receive buffer with SetReadBuffer from measurement.
+func (conn *TCPConn) QueueStats() QueueStats {
+	return QueueStats{
+		Len:       len(conn.chMessage),
+		Cap:       cap(conn.chMessage),
+		HighWater: int(atomic.LoadInt32(&conn.queueHigh)),
+		Dropped:   atomic.LoadUint64(&conn.dropped),
+	}
+}
+
+// Drain discards the datagrams queued for the readers without blocking, e.g.
+// the stale ones after a pause, and returns how many were discarded.
+func (conn *TCPConn) Drain() int {
+	var n int
+	for {
+		select {
+		case <-conn.chMessage:
+			n++
+		default:
+			return n
+		}
+	}
+}
+
+// DroppedSinceLastRead returns the number of packets dropped by the kernel
+// due to receive buffer overflow since the last successful ReadFrom.
+func (conn *TCPConn) DroppedSinceLastRead() uint64 {
+	return atomic.LoadUint64(&conn.dropped) - atomic.LoadUint64(&conn.droppedMark)
+}
+
+// WriteTo implements the PacketConn WriteTo method.
+// Every call sends p as a single segment, it's all-or-nothing: either n is
+// len(p), or n is 0 and err is a *net.OpError describing the failure.
+func (conn *TCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return conn.WriteMsg(p, SendMeta{}, addr)
+}
+
+// WriteMsg acts like WriteTo, and applies the per-packet settings in meta
+// to this datagram only, so header fields can vary packet by packet.
+func (conn *TCPConn) WriteMsg(p []byte, meta SendMeta, addr net.Addr) (n int, err error) {
+	n, err = conn.writeMsg(p, meta, addr)
+	if _, ok := err.(*net.OpError); err != nil && !ok {
+		err = &net.OpError{Op: "write", Net: "tcp", Source: conn.LocalAddr(), Addr: addr, Err: err}
+	}
+	return n, err
+}
+
+// writeMsg implements WriteMsg, the errors are wrapped by the caller
+func (conn *TCPConn) writeMsg(p []byte, meta SendMeta, addr net.Addr) (n int, err error) {
+	var deadline <-chan time.Time
+	if d, ok := conn.writeDeadline.Load().(time.Time); ok && !d.IsZero() {
+		timer := time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	if ch, ok := conn.chWrite.Load().(chan writeRequest); ok {
+		return conn.enqueueWrite(ch, p, meta, addr, deadline)
+	}
 
+	conn.writeLock.RLock()
+	defer conn.writeLock.RUnlock()
+
+	if conn.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	// a closed connection reports ErrClosed even if it was shut down before
+	select {
+	case <-conn.die:
+		return 0, ErrClosed
+	default:
+	}
+	select {
+	case <-deadline:
+		return 0, errTimeout
+	case <-conn.die:
+		return 0, ErrClosed
+	case <-conn.writeClosed:
+		return 0, errWriteShutdown
+	case <-conn.shutdown:
+		return 0, errWriteShutdown
+	case <-conn.gone:
+		return 0, ErrInterfaceGone
+	default:
+		if err := conn.checkMeta(meta); err != nil {
+			return 0, err
+		}
+
+		raddr, err := conn.resolveAddr(addr)
+		if err != nil {
+			return 0, err
+		}
+		return conn.inject(p, meta, addr, raddr, deadline)
+	}
+}
+
+// inject sends p to addr resolved as raddr, waiting for the inflight window
+// until deadline. The caller holds writeLock for reading.
+func (conn *TCPConn) inject(p []byte, meta SendMeta, addr net.Addr, raddr *net.TCPAddr, deadline <-chan time.Time) (n int, err error) {
+	for {
+		var wait chan struct{}
 		conn.lockflow(addr, func(e *tcpFlow) {
-			// if the flow doesn't have handle , assume this packet has lost, without notification
+			// a flow without handle has never been seen, nothing can be sent
 			if e.handle == nil {
-				n = len(p)
+				err = errNoHandle
 				return
 			}
 
-			// build tcp header with local and remote port
-			e.tcpHeader.SrcPort = layers.TCPPort(lport)
-			e.tcpHeader.DstPort = layers.TCPPort(raddr.Port)
-			binary.Read(rand.Reader, binary.LittleEndian, &e.tcpHeader.Window)
-			e.tcpHeader.Window |= 0x8000 // make sure it's larger than 32768
-			e.tcpHeader.Ack = e.ack
-			e.tcpHeader.Seq = e.seq
+			// wait for acknowledgements if p doesn't fit in the inflight
+			// window, a segment is always allowed on an idle flow
+			if max := uint64(atomic.LoadUint32(&conn.maxInflight)); max > 0 && e.seq > e.acked {
+				if e.seq-e.acked+uint64(len(p)) > max {
+					wait = conn.ackNotify
+					return
+				}
+			}
+
 			e.tcpHeader.PSH = true
 			e.tcpHeader.ACK = true
+			e.tcpHeader.FIN = false
+
+			// skip a random gap of sequence space, the skip is kept even if
+			// sending fails, a gap is harmless
+			if jitter := atomic.LoadInt32(&conn.seqJitter); jitter > 0 {
+				var r uint32
+				binary.Read(rand.Reader, binary.LittleEndian, &r)
+				e.seq += uint64(r % uint32(jitter+1))
+			}
+			if err = conn.output(e, raddr, p, meta); err != nil {
+				return
+			}
+			// increase seq in flow only if the segment was sent
+			e.seq += uint64(len(p))
+			n = len(p)
+			atomic.AddUint64(&conn.bytesSent, uint64(n))
+		})
+		if wait == nil {
+			break
+		}
 
-			// build IP header with src & dst ip for TCP checksum
-			if raddr.IP.To4() != nil {
-				ip := &layers.IPv4{
-					Protocol: layers.IPProtocolTCP,
-					SrcIP:    e.handle.LocalAddr().(*net.IPAddr).IP.To4(),
-					DstIP:    raddr.IP.To4(),
-				}
-				e.tcpHeader.SetNetworkLayerForChecksum(ip)
-			} else {
-				ip := &layers.IPv6{
-					NextHeader: layers.IPProtocolTCP,
-					SrcIP:      e.handle.LocalAddr().(*net.IPAddr).IP.To16(),
-					DstIP:      raddr.IP.To16(),
+		// don't hold off Close or reconfiguration while waiting
+		conn.writeLock.RUnlock()
+		select {
+		case <-wait:
+		case <-deadline:
+			err = errTimeout
+		case <-conn.die:
+			err = ErrClosed
+		}
+		conn.writeLock.RLock()
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case <-conn.die:
+			return 0, ErrClosed
+		case <-conn.writeClosed:
+			return 0, errWriteShutdown
+		default:
+		}
+	}
+	if err != nil {
+		conn.log().Warnf("write to %v failed: %v", addr, err)
+		if _, ok := err.(*net.OpError); !ok {
+			err = &net.OpError{Op: "write", Net: "tcp", Source: conn.LocalAddr(), Addr: addr, Err: err}
+		}
+		return 0, err
+	}
+	return
+}
+
+// writeRequest is a datagram queued for the injection worker, or a marker
+// closing flushed once the requests before it are sent.
+type writeRequest struct {
+	p       []byte
+	meta    SendMeta
+	addr    net.Addr
+	raddr   *net.TCPAddr
+	flushed chan struct{}
+}
+
+// SetWriteQueue routes the writes through a queue of size datagrams served by
+// a single injection goroutine, so that bursty writers don't contend for the
+// flow table and the sending is paced in one place. WriteTo returns once p is
+// queued, it blocks while the queue is full until the write deadline, that's
+// the backpressure. The errors of the queued writes are reported by Flush.
+// The queue can be set once, it's kept until the connection is closed.
+func (conn *TCPConn) SetWriteQueue(size int) error {
+	if size <= 0 {
+		return errors.New("non-positive write queue size")
+	}
+	if conn.readOnly {
+		return ErrReadOnly
+	}
+
+	err := errors.New("write queue already set")
+	conn.writeQueueOnce.Do(func() {
+		ch := make(chan writeRequest, size)
+		conn.chWrite.Store(ch)
+		go conn.writeLoop(ch)
+		err = nil
+	})
+	return err
+}
+
+// enqueueWrite queues p for the injection worker
+func (conn *TCPConn) enqueueWrite(ch chan writeRequest, p []byte, meta SendMeta, addr net.Addr, deadline <-chan time.Time) (int, error) {
+	conn.queueLock.RLock()
+	defer conn.queueLock.RUnlock()
+	select {
+	case <-conn.die:
+		return 0, ErrClosed
+	default:
+	}
+	select {
+	case <-conn.writeClosed:
+		return 0, errWriteShutdown
+	case <-conn.shutdown:
+		return 0, errWriteShutdown
+	case <-conn.gone:
+		return 0, ErrInterfaceGone
+	default:
+	}
+	if err := conn.checkMeta(meta); err != nil {
+		return 0, err
+	}
+	raddr, err := conn.resolveAddr(addr)
+	if err != nil {
+		return 0, err
+	}
+
+	bts := make([]byte, len(p))
+	copy(bts, p)
+	select {
+	case ch <- writeRequest{p: bts, meta: meta, addr: addr, raddr: raddr}:
+		return len(p), nil
+	case <-deadline:
+		return 0, errTimeout
+	case <-conn.die:
+		return 0, ErrClosed
+	}
+}
+
+// writeLoop injects the datagrams queued in ch until the connection is closed
+func (conn *TCPConn) writeLoop(ch chan writeRequest) {
+	for {
+		select {
+		case req := <-ch:
+			if req.flushed != nil {
+				close(req.flushed)
+				continue
+			}
+
+			conn.writeLock.RLock()
+			var err error
+			select {
+			case <-conn.die:
+				err = ErrClosed
+			case <-conn.writeClosed:
+				err = errWriteShutdown
+			default:
+				_, err = conn.inject(req.p, req.meta, req.addr, req.raddr, nil)
+			}
+			conn.writeLock.RUnlock()
+
+			if err != nil {
+				conn.writeErrLock.Lock()
+				if conn.writeErr == nil {
+					conn.writeErr = err
 				}
-				e.tcpHeader.SetNetworkLayerForChecksum(ip)
+				conn.writeErrLock.Unlock()
 			}
+		case <-conn.die:
+			return
+		}
+	}
+}
 
-			e.buf.Clear()
-			gopacket.SerializeLayers(e.buf, conn.opts, &e.tcpHeader, gopacket.Payload(p))
-			if conn.tcpconn != nil {
-				_, err = e.handle.Write(e.buf.Bytes())
-			} else {
-				_, err = e.handle.WriteToIP(e.buf.Bytes(), &net.IPAddr{IP: raddr.IP})
+// Flush waits until the datagrams queued by SetWriteQueue are sent, and
+// returns the first error of the queued writes since the last Flush. Without
+// a write queue every WriteTo is sent immediately and it's a no-op.
+func (conn *TCPConn) Flush() error {
+	ch, ok := conn.chWrite.Load().(chan writeRequest)
+	if !ok {
+		return nil
+	}
+
+	flushed := make(chan struct{})
+	select {
+	case ch <- writeRequest{flushed: flushed}:
+	case <-conn.die:
+		return ErrClosed
+	}
+	select {
+	case <-flushed:
+	case <-conn.die:
+		return ErrClosed
+	}
+
+	conn.writeErrLock.Lock()
+	defer conn.writeErrLock.Unlock()
+	err := conn.writeErr
+	conn.writeErr = nil
+	return err
+}
+
+// resolvedAddr is a remote address cached by resolveAddr
+type resolvedAddr struct {
+	key   string
+	raddr *net.TCPAddr
+}
+
+// resolveAddr returns addr as a *net.TCPAddr, the last address resolved is
+// cached so that writing repeatedly to the same peer doesn't resolve again.
+func (conn *TCPConn) resolveAddr(addr net.Addr) (*net.TCPAddr, error) {
+	if raddr, ok := addr.(*net.TCPAddr); ok {
+		return raddr, nil
+	}
+	key := addr.String()
+	if c, ok := conn.lastAddr.Load().(resolvedAddr); ok && c.key == key {
+		return c.raddr, nil
+	}
+	raddr, err := net.ResolveTCPAddr("tcp", key)
+	if err != nil {
+		return nil, err
+	}
+	conn.lastAddr.Store(resolvedAddr{key, raddr})
+	return raddr, nil
+}
+
+// localPort returns the local TCP port of this connection
+func (conn *TCPConn) localPort() int {
+	return int(atomic.LoadInt32(&conn.lport))
+}
+
+// remoteAddr returns the remote endpoint of a dialed connection, the port
+// may be changed by SetPorts, conn.raddr only holds the IP and zone.
+func (conn *TCPConn) remoteAddr() *net.TCPAddr {
+	return &net.TCPAddr{IP: conn.raddr.IP, Port: int(atomic.LoadInt32(&conn.rport)), Zone: conn.raddr.Zone}
+}
+
+// client returns the hijacked TCP connection of a dialed connection,
+// it may be replaced by Rebind.
+func (conn *TCPConn) client() *net.TCPConn {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	return conn.tcpconn
+}
+
+// output serializes a TCP segment carrying payload p on flow e and sends it
+// to raddr, flags are taken from e.tcpHeader as set by the caller.
+// The flow table must be locked by the caller.
+func (conn *TCPConn) output(e *tcpFlow, raddr *net.TCPAddr, p []byte, meta SendMeta) (err error) {
+	// the kernel has copied the packet once WriteMsgIP returns, the buffer
+	// is recycled after the last attempt
+	src := e.handle.LocalAddr().(*net.IPAddr).IP
+	pool := conn.buffers(src)
+	buf := pool.get()
+	defer pool.put(buf)
+	oob, err := conn.serialize(e, buf, src, raddr, p, meta, conn.ipid.Load().(IPIDFunc))
+	if err != nil {
+		return err
+	}
+
+	retries := atomic.LoadInt32(&conn.injectRetries)
+	for {
+		if conn.tcpconn != nil {
+			err = writeConnected(e.handle, buf.Bytes(), oob)
+		} else {
+			_, _, err = e.handle.WriteMsgIP(buf.Bytes(), oob, &net.IPAddr{IP: raddr.IP})
+		}
+		if err == nil {
+			atomic.StoreUint64(&conn.congested, 0)
+			return nil
+		}
+		if isRetryable(err) {
+			atomic.AddUint64(&conn.congested, 1)
+		}
+		if !isRetryable(err) || retries <= 0 {
+			return &injectError{err}
+		}
+		retries--
+	}
+}
+
+// serialize builds the segment of output from src to raddr into buf, and
+// returns the ancillary data to send along with it. ipid generates the
+// Identification of an IPv4 header.
+func (conn *TCPConn) serialize(e *tcpFlow, buf gopacket.SerializeBuffer, src net.IP, raddr *net.TCPAddr, p []byte, meta SendMeta, ipid IPIDFunc) (oob []byte, err error) {
+	// connection defaults of the per-packet settings
+	if meta.TTL == 0 {
+		meta.TTL = int(atomic.LoadInt32(&conn.ttl))
+	}
+	if meta.Window == 0 {
+		meta.Window = int(atomic.LoadInt32(&conn.window))
+	}
+
+	// build tcp header with local and remote port
+	e.tcpHeader.SrcPort = layers.TCPPort(conn.localPort())
+	e.tcpHeader.DstPort = layers.TCPPort(raddr.Port)
+	select {
+	case <-conn.readClosed: // advertise zero window when we stop reading
+		e.tcpHeader.Window = 0
+	default:
+		if meta.Window > 0 {
+			e.tcpHeader.Window = uint16(meta.Window)
+		} else {
+			binary.Read(rand.Reader, binary.LittleEndian, &e.tcpHeader.Window)
+			e.tcpHeader.Window |= 0x8000 // make sure it's larger than 32768
+		}
+	}
+	e.tcpHeader.Ack = uint32(e.ack)
+	e.tcpHeader.Seq = uint32(e.seq)
+	e.tcpHeader.Options = e.tcpHeader.Options[:0]
+	if atomic.LoadInt32(&conn.echoTimestamps) != 0 && !e.tsSeen.IsZero() {
+		// continue the clock echoed by the peer, which was started by the kernel
+		tsval := e.tsecr + uint32(time.Since(e.tsSeen)/time.Millisecond)
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint32(data, tsval)
+		binary.BigEndian.PutUint32(data[4:], e.tsval)
+		e.tcpHeader.Options = append(e.tcpHeader.Options,
+			layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+			layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+			layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: data})
+	}
+	if !conn.opts.FixLengths {
+		// the header keeps the offset fixed last time otherwise
+		e.tcpHeader.DataOffset = uint8(meta.DataOffset)
+		if meta.DataOffset == 0 {
+			e.tcpHeader.DataOffset = uint8(tcpHeaderLen(&e.tcpHeader) / 4)
+		}
+	}
+
+	// build IP header with src & dst ip for TCP checksum
+	buf.Clear()
+	if raddr.IP.To4() != nil {
+		ip := &e.ip4
+		*ip = layers.IPv4{
+			Version:  4,
+			TOS:      uint8(atomic.LoadInt32(&conn.tos)),
+			TTL:      defaultTTL,
+			Id:       ipid(),
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    src.To4(),
+			DstIP:    raddr.IP.To4(),
+		}
+		if atomic.LoadInt32(&conn.noDF) == 0 {
+			ip.Flags = layers.IPv4DontFragment
+		}
+		if meta.TTL > 0 {
+			ip.TTL = uint8(meta.TTL)
+		}
+		if meta.DSCP > 0 {
+			ip.TOS = uint8(meta.DSCP << 2)
+		}
+		if !conn.opts.FixLengths {
+			ip.IHL = 5 // no options, the header is unusable otherwise
+		}
+		e.tcpHeader.SetNetworkLayerForChecksum(ip)
+
+		// IPv4 handles are in IP_HDRINCL mode, the IP header is sent as built
+		err = gopacket.SerializeLayers(buf, conn.opts, ip, &e.tcpHeader, gopacket.Payload(p))
+	} else if conn.flowLabel != 0 {
+		ip := &e.ip6
+		*ip = layers.IPv6{
+			Version:      6,
+			TrafficClass: uint8(atomic.LoadInt32(&conn.tos) >> 2),
+			FlowLabel:    conn.flowLabel,
+			NextHeader:   layers.IPProtocolTCP,
+			HopLimit:     defaultTTL,
+			SrcIP:        src.To16(),
+			DstIP:        raddr.IP.To16(),
+		}
+		if meta.TTL > 0 {
+			ip.HopLimit = uint8(meta.TTL)
+		}
+		if meta.DSCP > 0 {
+			ip.TrafficClass = uint8(meta.DSCP)
+		}
+		if !conn.opts.FixLengths {
+			ip.Length = uint16(meta.IPLength)
+			if meta.IPLength == 0 {
+				ip.Length = uint16(tcpHeaderLen(&e.tcpHeader) + len(p))
 			}
-			// increase seq in flow
-			e.seq += uint32(len(p))
-			n = len(p)
+		}
+		e.tcpHeader.SetNetworkLayerForChecksum(ip)
+
+		// IPv6 handles are in IPV6_HDRINCL mode to carry the flow label
+		err = gopacket.SerializeLayers(buf, conn.opts, ip, &e.tcpHeader, gopacket.Payload(p))
+	} else {
+		ip := &e.ip6
+		*ip = layers.IPv6{
+			NextHeader: layers.IPProtocolTCP,
+			SrcIP:      src.To16(),
+			DstIP:      raddr.IP.To16(),
+		}
+		e.tcpHeader.SetNetworkLayerForChecksum(ip)
+		err = gopacket.SerializeLayers(buf, conn.opts, &e.tcpHeader, gopacket.Payload(p))
+		oob = sendControl(meta)
+	}
+	return oob, err
+}
+
+// BuildPacket returns the bytes WriteTo would inject to carry p to addr,
+// nothing is sent and the flow doesn't change, the IPv4 Identification is 0
+// as no id is taken from the IPIDFunc. IPv4 packets start at the IP header,
+// IPv6 packets start at the TCP header as the kernel adds the rest, unless a
+// flow label is set. Until a packet has been captured from addr, the source
+// IP is unspecified and the sequence numbers are zero.
+func (conn *TCPConn) BuildPacket(p []byte, addr net.Addr) ([]byte, error) {
+	raddr, err := conn.resolveAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// serialize from a copy, the headers of the flow are shared with writers
+	var e tcpFlow
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	if flow := conn.flowTable[addr.String()]; flow != nil {
+		e = *flow
+		e.tcpHeader.Options = nil
+	}
+
+	src := net.IPv4zero
+	if raddr.IP.To4() == nil {
+		src = net.IPv6unspecified
+	}
+	if e.handle != nil {
+		src = e.handle.LocalAddr().(*net.IPAddr).IP
+	}
+
+	e.tcpHeader.PSH = true
+	e.tcpHeader.ACK = true
+	e.tcpHeader.FIN = false
+	pool := conn.buffers(src)
+	buf := pool.get()
+	defer pool.put(buf)
+	if _, err := conn.serialize(&e, buf, src, raddr, p, SendMeta{}, func() uint16 { return 0 }); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// SetBufferPool sets the capacity of the buffers segments are serialized
+// into. They're shared by the flows through a sync.Pool, so the memory
+// follows the concurrent writes rather than the number of flows. 0, the
+// default, sizes them to the MTU of the interfaces, a larger segment grows its
+// buffer which isn't recycled then. A negative size turns recycling off, a
+// buffer is allocated for every segment.
+func (conn *TCPConn) SetBufferPool(size int) error {
+	if size == 0 {
+		size = conn.MTU()
+		if size <= 0 {
+			size = defaultBufferSize
+		}
+	}
+	conn.bufPoolOnce.Do(func() {})
+	conn.bufPool.Store(newBufferPool(size))
+	return nil
+}
+
+// buffers returns the pool of serialize buffers, created on first use and
+// sized to the MTU of the interface of src. It doesn't lock the flow table,
+// which the callers may hold.
+func (conn *TCPConn) buffers(src net.IP) *bufferPool {
+	conn.bufPoolOnce.Do(func() {
+		size := defaultBufferSize
+		if iface := interfaceByIP(src); iface != nil && iface.MTU > 0 {
+			size = iface.MTU
+		}
+		conn.bufPool.Store(newBufferPool(size))
+	})
+	return conn.bufPool.Load().(*bufferPool)
+}
+
+// CloseRead shuts down the reading side of the connection, captured payloads
+// are discarded from now on and a zero window is advertised to the peer.
+func (conn *TCPConn) CloseRead() error {
+	conn.readCloseOnce.Do(func() {
+		close(conn.readClosed)
+	})
+	return nil
+}
+
+// CloseWrite shuts down the writing side of the connection, a FIN is sent
+// on every flow through the raw path and further WriteTo calls are rejected.
+func (conn *TCPConn) CloseWrite() error {
+	if conn.readOnly {
+		return ErrReadOnly
+	}
+
+	var err error
+	conn.writeCloseOnce.Do(func() {
+		close(conn.writeClosed)
+
+		conn.writeLock.RLock()
+		defer conn.writeLock.RUnlock()
+		select {
+		case <-conn.die:
+			err = ErrClosed
+			return
+		default:
+		}
+
+		conn.flowsLock.Lock()
+		defer conn.flowsLock.Unlock()
+		for k, e := range conn.flowTable {
+			if e.handle == nil || e.conn == nil {
+				continue
+			}
+			raddr, rerr := net.ResolveTCPAddr("tcp", k)
+			if rerr != nil {
+				continue
+			}
+
+			e.tcpHeader.PSH = false
+			e.tcpHeader.ACK = true
+			e.tcpHeader.FIN = true
+			if werr := conn.output(e, raddr, nil, SendMeta{}); werr != nil {
+				err = werr
+				continue
+			}
+			e.seq++ // FIN consumes one sequence number
+		}
+	})
+	return err
+}
+
+// Rebind re-establishes the hijacked TCP connection to the same remote endpoint
+// from a new local port, and switches this connection over to it. It recovers
+// a dialed connection after the source port mapping is lost, like a NAT
+// rebinding or a suspend/resume cycle. Sequence numbers are re-learned from the
+// new handshake. On failure the connection keeps its old port. It's not
+// available on connections from Listen.
+func (conn *TCPConn) Rebind() error {
+	if conn.raddr == nil || conn.readOnly {
+		return errOpNotImplemented
+	}
+
+	// bind the socket before connecting so that the capture can follow the new
+	// port before the handshake reply arrives, the old port is restored if
+	// the new connection can't be established
+	oldPort := atomic.LoadInt32(&conn.lport)
+	var rebound bool
+	restore := func() {
+		if !rebound {
+			return
+		}
+		atomic.StoreInt32(&conn.lport, oldPort)
+		if _, ok := conn.filter.Load().([]syscall.SockFilter); !ok {
+			for k := range conn.handles {
+				setFilter(conn.handles[k], int(oldPort))
+			}
+		}
+	}
+	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		var port int
+		var err error
+		c.Control(func(fd uintptr) {
+			port, err = bindAnyPort(int(fd), conn.raddr.IP.To4() != nil)
 		})
+		if err != nil {
+			return err
+		}
+		rebound = true
+		atomic.StoreInt32(&conn.lport, int32(port))
+		if _, ok := conn.filter.Load().([]syscall.SockFilter); !ok {
+			for k := range conn.handles {
+				setFilter(conn.handles[k], port)
+			}
+		}
+		return nil
+	}}
+
+	start := time.Now()
+	c, err := dialer.Dial("tcp", conn.remoteAddr().String())
+	if err != nil {
+		restore()
+		return err
 	}
-	return
+	tcpconn := c.(*net.TCPConn)
+	if err := setTTL(tcpconn, 1); err != nil {
+		tcpconn.Close()
+		restore()
+		return err
+	}
+	if err := quiesce(tcpconn); err != nil {
+		tcpconn.Close()
+		restore()
+		return err
+	}
+
+	var old *net.TCPConn
+	conn.lockflow(conn.remoteAddr(), func(e *tcpFlow) {
+		select {
+		case <-conn.die:
+			return
+		default:
+		}
+		old = conn.tcpconn
+		conn.tcpconn = tcpconn
+		e.conn = tcpconn
+
+		// the state left by the old connection, the sequence numbers are
+		// re-learned from the captured handshake
+		e.closed = false
+		if e.tsSeen.Before(start) {
+			e.tsval, e.tsecr, e.tsSeen = 0, 0, time.Time{}
+		}
+
+		// discard everything, Close takes the flow table lock after die is
+		// closed and before it waits for conn.wg, so the Add can't race it
+		conn.discard(tcpconn)
+	})
+	if old == nil { // closed meanwhile
+		tcpconn.Close()
+		restore()
+		return ErrClosed
+	}
+	setTTL(old, 64)
+	old.Close()
+	return nil
+}
+
+// discard drains the hijacked kernel socket until it's closed,
+// Close waits for it to return.
+func (conn *TCPConn) discard(tcpconn *net.TCPConn) {
+	conn.wg.Add(1)
+	go func() {
+		defer conn.wg.Done()
+		io.Copy(ioutil.Discard, tcpconn)
+	}()
+}
+
+// Sequence returns the sequence and acknowledge numbers of the flow to addr,
+// extended to 64 bits to count wraps, the low 32 bits are the ones on the wire.
+func (conn *TCPConn) Sequence(addr net.Addr) (seq, ack uint64, ok bool) {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	if e := conn.flowTable[addr.String()]; e != nil {
+		return e.seq, e.ack, true
+	}
+	return 0, 0, false
+}
+
+// SetPorts changes the local and remote ports of a dialed connection in place,
+// to follow a NAT rebinding detected out of band without dialing again.
+// Captured segments are matched against the new ports, outgoing segments carry
+// them, and the flow state moves over to the new remote address. The hijacked
+// kernel socket keeps its original port. It's not available on connections
+// from Listen.
+func (conn *TCPConn) SetPorts(src, dst uint16) error {
+	if conn.raddr == nil {
+		return errOpNotImplemented
+	}
+	if src == 0 || dst == 0 {
+		return errors.New("zero port")
+	}
+
+	// no segment is sent while the ports change
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	select {
+	case <-conn.die:
+		return ErrClosed
+	default:
+	}
+
+	old := conn.remoteAddr()
+	raddr := &net.TCPAddr{IP: old.IP, Port: int(dst), Zone: old.Zone}
+	conn.flowsLock.Lock()
+	if e := conn.flowTable[old.String()]; e != nil {
+		delete(conn.flowTable, old.String())
+		conn.flowTable[raddr.String()] = e
+	}
+	atomic.StoreInt32(&conn.lport, int32(src))
+	atomic.StoreInt32(&conn.rport, int32(dst))
+	conn.flowsLock.Unlock()
+
+	if _, ok := conn.filter.Load().([]syscall.SockFilter); !ok {
+		for k := range conn.handles {
+			setFilter(conn.handles[k], int(src))
+		}
+	}
+
+	// the rules match the remote port
+	if old.Port != raddr.Port && !conn.readOnly {
+		if conn.iptables != nil {
+			deleteRule(conn.iptables, iptables.ProtocolIPv4, conn.iprule)
+			conn.iptables = nil
+		}
+		if conn.ip6tables != nil {
+			deleteRule(conn.ip6tables, iptables.ProtocolIPv6, conn.ip6rule)
+			conn.ip6tables = nil
+		}
+		if conn.ttltables != nil {
+			deleteRule(conn.ttltables, iptables.ProtocolIPv4, conn.ttlrule)
+			conn.ttltables = nil
+		}
+		conn.installDialRules(raddr)
+	}
+	return nil
+}
+
+// peerClosed reports whether the peer of a dialed connection has sent RST or FIN
+func (conn *TCPConn) peerClosed() bool {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	e := conn.flowTable[conn.remoteAddr().String()]
+	return e != nil && e.closed
+}
+
+// ConnState is a consistent view of the TCP state of a flow
+type ConnState struct {
+	Seq        uint64 // sequence number, extended to 64 bits across wraps
+	Ack        uint64 // acknowledge number, extended to 64 bits across wraps
+	PeerWindow uint16 // latest window advertised by the peer, unscaled
+}
+
+// Snapshot returns the state of the flow to addr, all fields are taken under
+// the same lock, so they're never torn by a concurrent update.
+func (conn *TCPConn) Snapshot(addr net.Addr) (state ConnState, ok bool) {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	if e := conn.flowTable[addr.String()]; e != nil {
+		return ConnState{Seq: e.seq, Ack: e.ack, PeerWindow: e.window}, true
+	}
+	return ConnState{}, false
+}
+
+// PeerTimestamp returns the latest TSval and TSecr of the TCP timestamp option
+// received from the peer at addr, ok is false if the peer never sent one.
+func (conn *TCPConn) PeerTimestamp(addr net.Addr) (tsval, tsecr uint32, ok bool) {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	if e := conn.flowTable[addr.String()]; e != nil && !e.tsSeen.IsZero() {
+		return e.tsval, e.tsecr, true
+	}
+	return 0, 0, false
+}
+
+// SetReadLimit bounds the payload size of a received datagram to n bytes, 0
+// means unlimited. Larger payloads are truncated as they are captured, and the
+// read returning such a datagram reports ErrReadLimit along with the data.
+// ReadBatch ends the batch at the truncated datagram.
+func (conn *TCPConn) SetReadLimit(n int) error {
+	if n < 0 {
+		return errors.New("negative read limit")
+	}
+	atomic.StoreInt32(&conn.readLimit, int32(n))
+	return nil
+}
+
+// SetInspect enables inspect mode, a copy of every captured packet destined to
+// the local port is queued for ReadRawPacket, alongside the normal delivery of
+// payloads. Packets are discarded when the queue is full, so capture never
+// waits for an inspector.
+func (conn *TCPConn) SetInspect(inspect bool) error {
+	var v int32
+	if inspect {
+		v = 1
+	}
+	atomic.StoreInt32(&conn.inspect, v)
+	return nil
+}
+
+// Event is the TCP header of a captured segment, as recorded by SetEventLog
+type Event struct {
+	Time  time.Time
+	Addr  net.Addr // the sender of the segment
+	Seq   uint32   // sequence number on the wire
+	Ack   uint32   // acknowledge number on the wire
+	Flags TCPFlags
+}
+
+// SetEventLog keeps the headers of the latest size segments captured on the
+// connection for RecentEvents, to trace a desynchronized flow. 0 disables it,
+// which is the default, and discards the events recorded.
+func (conn *TCPConn) SetEventLog(size int) error {
+	if size < 0 {
+		return errors.New("negative event log size")
+	}
+	conn.eventsLock.Lock()
+	defer conn.eventsLock.Unlock()
+	conn.events = make([]Event, 0, size)
+	conn.eventNext = 0
+	atomic.StoreInt32(&conn.eventLogSize, int32(size))
+	return nil
+}
+
+// RecentEvents returns the events recorded by SetEventLog, the oldest first
+func (conn *TCPConn) RecentEvents() []Event {
+	conn.eventsLock.Lock()
+	defer conn.eventsLock.Unlock()
+	events := make([]Event, 0, len(conn.events))
+	events = append(events, conn.events[conn.eventNext:]...)
+	return append(events, conn.events[:conn.eventNext]...)
 }
 
-// Close closes the connection.
+// logEvent records ev in the ring of events, overwriting the oldest when full
+func (conn *TCPConn) logEvent(ev Event) {
+	conn.eventsLock.Lock()
+	defer conn.eventsLock.Unlock()
+	if len(conn.events) < cap(conn.events) {
+		conn.events = append(conn.events, ev)
+		return
+	}
+	if len(conn.events) > 0 {
+		conn.events[conn.eventNext] = ev
+		conn.eventNext = (conn.eventNext + 1) % len(conn.events)
+	}
+}
+
+// SetDeliverControl enables delivering the segments without PSH flag, like
+// SYN, FIN, RST and pure ACK, as empty datagrams, along with the segments
+// with PSH flag but no payload. Use ReadMsg to tell them
+// apart by RecvMeta.Flags. Control segments of flows not yet accepted by a
+// listener are delivered as well, so the whole control flow can be observed.
+func (conn *TCPConn) SetDeliverControl(deliver bool) error {
+	var v int32
+	if deliver {
+		v = 1
+	}
+	atomic.StoreInt32(&conn.deliverControl, v)
+	return nil
+}
+
+// SetEchoTimestamps enables the TCP timestamp option on outgoing segments for
+// the flows which the peer has sent timestamps on, the peer's latest TSval is
+// echoed as TSecr.
+func (conn *TCPConn) SetEchoTimestamps(echo bool) error {
+	var v int32
+	if echo {
+		v = 1
+	}
+	atomic.StoreInt32(&conn.echoTimestamps, v)
+	return nil
+}
+
+// Close closes the connection. It's idempotent and safe to call concurrently,
+// only the first call closes the sockets and reports their errors, the others
+// wait for it to complete and return nil.
 func (conn *TCPConn) Close() error {
+	return conn.close(true)
+}
+
+// close implements Close, wait tells whether to wait for the writes in
+// progress before the sockets are closed under them.
+func (conn *TCPConn) close(wait bool) error {
 	var err error
 	conn.dieOnce.Do(func() {
 		// signal closing
 		close(conn.die)
 
+		// wait for in-flight writes, later writes will see die closed
+		if wait {
+			conn.writeLock.Lock()
+			defer conn.writeLock.Unlock()
+		}
+
 		// close all established tcp connections
-		if conn.tcpconn != nil { // client
-			setTTL(conn.tcpconn, 64)
-			err = conn.tcpconn.Close()
+		if tcpconn := conn.client(); tcpconn != nil { // client
+			setTTL(tcpconn, 64)
+			err = tcpconn.Close()
 		} else if conn.listener != nil {
 			err = conn.listener.Close() // server
 			conn.flowsLock.Lock()
@@ -310,24 +2223,88 @@ func (conn *TCPConn) Close() error {
 		for k := range conn.handles {
 			conn.handles[k].Close()
 		}
+		conn.flowsLock.Lock()
+		for k := range conn.icmpHandles {
+			conn.icmpHandles[k].Close()
+		}
+		conn.flowsLock.Unlock()
+
+		// end subscriptions
+		conn.subsLock.Lock()
+		for ch := range conn.subs {
+			close(ch)
+			delete(conn.subs, ch)
+		}
+		conn.subsLock.Unlock()
+
+		// delete iptable
+		if conn.iptables != nil {
+			deleteRule(conn.iptables, iptables.ProtocolIPv4, conn.iprule)
+		}
+		if conn.ip6tables != nil {
+			deleteRule(conn.ip6tables, iptables.ProtocolIPv6, conn.ip6rule)
+		}
+		if conn.ttltables != nil {
+			deleteRule(conn.ttltables, iptables.ProtocolIPv4, conn.ttlrule)
+		}
+	})
+
+	// the kernel sockets are closed, wait for the goroutines draining them
+	conn.wg.Wait()
+	return err
+}
+
+// Shutdown closes the connection gracefully: new writes are rejected, then
+// it waits for the WriteTo calls in progress and the datagrams queued by
+// SetWriteQueue to be sent, before closing as Close does. If ctx expires
+// first, the connection is closed without waiting further, the writes in
+// progress fail, and ctx.Err() is returned.
+func (conn *TCPConn) Shutdown(ctx context.Context) error {
+	conn.shutdownOnce.Do(func() {
+		close(conn.shutdown)
+	})
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+
+		// the writers being queued finish, the later ones see shutdown
+		conn.queueLock.Lock()
+		conn.queueLock.Unlock()
+		if ch, ok := conn.chWrite.Load().(chan writeRequest); ok {
+			flushed := make(chan struct{})
+			select {
+			case ch <- writeRequest{flushed: flushed}:
+				select {
+				case <-flushed:
+				case <-conn.die:
+				}
+			case <-conn.die:
+			}
+		}
 
-		// delete iptable
-		if conn.iptables != nil {
-			conn.iptables.Delete("filter", "OUTPUT", conn.iprule...)
-		}
-		if conn.ip6tables != nil {
-			conn.ip6tables.Delete("filter", "OUTPUT", conn.ip6rule...)
-		}
-	})
-	return err
+		// the writers hold the read lock while sending
+		conn.writeLock.Lock()
+		conn.writeLock.Unlock()
+	}()
+
+	select {
+	case <-drained:
+		return conn.Close()
+	case <-ctx.Done():
+		conn.close(false)
+		return ctx.Err()
+	}
 }
 
 // LocalAddr returns the local network address.
 func (conn *TCPConn) LocalAddr() net.Addr {
-	if conn.tcpconn != nil {
-		return conn.tcpconn.LocalAddr()
+	if tcpconn := conn.client(); tcpconn != nil {
+		return tcpconn.LocalAddr()
 	} else if conn.listener != nil {
 		return conn.listener.Addr()
+	} else if conn.readOnly {
+		return &net.TCPAddr{IP: conn.handles[0].LocalAddr().(*net.IPAddr).IP, Port: conn.localPort()}
 	}
 	return nil
 }
@@ -355,17 +2332,304 @@ func (conn *TCPConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+// MTU returns the largest MTU of the network interfaces this connection sends
+// and receives on, which bounds the frame size achievable without fragmentation.
+// The payload passed to WriteTo should leave room for the IP and TCP headers.
+func (conn *TCPConn) MTU() int {
+	var ips []net.IP
+	if tcpconn := conn.client(); tcpconn != nil {
+		ips = append(ips, tcpconn.LocalAddr().(*net.TCPAddr).IP)
+	} else {
+		for k := range conn.handles {
+			ips = append(ips, conn.handles[k].LocalAddr().(*net.IPAddr).IP)
+		}
+	}
+
+	var mtu int
+	for _, ip := range ips {
+		if iface := interfaceByIP(ip); iface != nil && iface.MTU > mtu {
+			mtu = iface.MTU
+		}
+	}
+	return mtu
+}
+
+// Interface returns the name of the network interface capturing this
+// connection, it's empty if unknown, or if a listener captures on several.
+func (conn *TCPConn) Interface() string {
+	var name string
+	for k := range conn.handles {
+		iface := interfaceByIP(conn.handles[k].LocalAddr().(*net.IPAddr).IP)
+		if iface == nil || (name != "" && name != iface.Name) {
+			return ""
+		}
+		name = iface.Name
+	}
+	return name
+}
+
+// ChecksumOffloadActive tells whether the interface of the connection computes
+// the checksums of transmitted packets, i.e. whether it's safe to disable
+// ComputeChecksums with SetSerializeOptions. It's a best-effort query through
+// the ethtool ioctl, interfaces without the ethtool support report false.
+func (conn *TCPConn) ChecksumOffloadActive() (bool, error) {
+	name := conn.Interface()
+	if name == "" {
+		return false, errors.New("no single interface for the connection")
+	}
+	return txChecksumOffload(name)
+}
+
 // SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
+// dscp ranges over 0-63, the ECN bits are left to the kernel.
 func (conn *TCPConn) SetDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return errors.New("DSCP out of range")
+	}
 	for k := range conn.handles {
 		if err := setDSCP(conn.handles[k], dscp); err != nil {
 			return err
 		}
 	}
+	atomic.StoreInt32(&conn.tos, int32(dscp<<2))
+	return nil
+}
+
+// SetIPID sets the strategy generating the Identification field of outgoing
+// IPv4 packets, the default is IPIDIncrement.
+func (conn *TCPConn) SetIPID(f IPIDFunc) error {
+	if f == nil {
+		return errors.New("nil IPIDFunc")
+	}
+	conn.ipid.Store(f)
+	return nil
+}
+
+// SetAcceptFunc sets f to be called for every new client of a listener, in
+// the goroutine accepting them, before any of its datagrams is delivered.
+// A client is rejected if f returns false, its kernel connection is closed
+// and its segments are ignored. nil accepts all, which is the default.
+// Set it right after Listen, the clients accepted meanwhile are not checked.
+func (conn *TCPConn) SetAcceptFunc(f AcceptFunc) error {
+	if conn.listener == nil {
+		return errors.New("not a listener")
+	}
+	conn.accept.Store(f)
+	return nil
+}
+
+// Backpressure returns the number of consecutive injection attempts rejected
+// by the kernel with ENOBUFS or EAGAIN, it's reset by the next successful send.
+// A growing value means the NIC queue is full and producers should slow down.
+func (conn *TCPConn) Backpressure() uint64 {
+	return atomic.LoadUint64(&conn.congested)
+}
+
+// SetInjectRetries sets how many extra attempts are made to send a segment
+// when the raw socket reports a retryable error like ENOBUFS, default is 0.
+func (conn *TCPConn) SetInjectRetries(n int) error {
+	if n < 0 {
+		return errors.New("negative retries")
+	}
+	atomic.StoreInt32(&conn.injectRetries, int32(n))
+	return nil
+}
+
+// SetMaxInflight bounds the bytes sent but not yet acknowledged by the peer
+// on each flow, 0 means unlimited. A write which would exceed it blocks until
+// the peer acknowledges enough data, honoring the write deadline. A segment is
+// always sent on a flow with nothing in flight, even if it's larger.
+func (conn *TCPConn) SetMaxInflight(bytes uint32) error {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	atomic.StoreUint32(&conn.maxInflight, bytes)
+
+	// blocked writers re-check against the new window
+	close(conn.ackNotify)
+	conn.ackNotify = make(chan struct{})
+	return nil
+}
+
+// SetSeqJitter makes every outgoing segment skip a random gap of 0 to max
+// bytes in sequence space, so the sequence numbers on the wire no longer grow
+// exactly by the payload sizes. A tcpraw peer follows the gaps, as it only
+// tracks the latest segment. A stateful middlebox or a kernel TCP stack sees
+// the gaps as lost data and may drop or hold back the following segments,
+// keep max small, well below the peer's window, or leave it at 0 to disable.
+func (conn *TCPConn) SetSeqJitter(max int) error {
+	if max < 0 {
+		return errors.New("negative sequence jitter")
+	}
+	atomic.StoreInt32(&conn.seqJitter, int32(max))
+	return nil
+}
+
+// SetSerializeOptions sets the options serializing outgoing segments, the
+// default computes checksums and fixes lengths. Turning them off sends the
+// fields as they're built, e.g. to craft malformed segments for testing.
+func (conn *TCPConn) SetSerializeOptions(opts gopacket.SerializeOptions) error {
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	conn.opts = opts
+	return nil
+}
+
+// SetFlowLabel sets the 20bit Flow Label of outgoing IPv6 packets, to keep a
+// flow on one path under ECMP hashing, 0 restores the default. The kernel
+// doesn't take a flow label from raw sockets, so a non-zero label switches the
+// IPv6 handles to IPV6_HDRINCL, which requires Linux 4.5 or later.
+func (conn *TCPConn) SetFlowLabel(label uint32) error {
+	if label > 0xfffff {
+		return errors.New("flow label out of range")
+	}
+
+	var hdrincl int
+	if label != 0 {
+		hdrincl = 1
+	}
+	conn.flowsLock.Lock()
+	defer conn.flowsLock.Unlock()
+	for k := range conn.handles {
+		if conn.handles[k].LocalAddr().(*net.IPAddr).IP.To4() != nil {
+			continue
+		}
+		raw, err := conn.handles[k].SyscallConn()
+		if err != nil {
+			return err
+		}
+		raw.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6HDRINCL, hdrincl)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	conn.flowLabel = label
+	return nil
+}
+
+// SetDontFragment controls the Don't-Fragment flag in IPv4 header of the
+// outgoing packets, it's set by default. Clearing it allows routers on the path
+// to fragment the packets instead of relying on path MTU discovery, packets
+// larger than the local MTU are still rejected.
+// For IPv6, it allows the local stack to fragment packets larger than the path MTU.
+func (conn *TCPConn) SetDontFragment(df bool) error {
+	for k := range conn.handles {
+		if err := setDF(conn.handles[k], df); err != nil {
+			return err
+		}
+	}
+	var v int32
+	if !df {
+		v = 1
+	}
+	atomic.StoreInt32(&conn.noDF, v)
+	return nil
+}
+
+// Options is a bundle of tunables of a connection, see SetOptions. The zero
+// value holds the defaults.
+type Options struct {
+	TTL            int    // TTL in IPv4 header, or Hop Limit in IPv6 header, 0 for 64
+	Window         int    // Window in TCP header, 0 for a random window
+	DSCP           int    // see SetDSCP
+	Fragment       bool   // clear Don't-Fragment, see SetDontFragment
+	InjectRetries  int    // see SetInjectRetries
+	SeqJitter      int    // see SetSeqJitter
+	MaxInflight    uint32 // see SetMaxInflight
+	ReadLimit      int    // see SetReadLimit
+	EchoTimestamps bool   // see SetEchoTimestamps
+	DeliverControl bool   // see SetDeliverControl
+	EventLog       int    // see SetEventLog, the events are kept if it's unchanged
+}
+
+// Options returns the tunables in effect
+func (conn *TCPConn) Options() Options {
+	return Options{
+		TTL:            int(atomic.LoadInt32(&conn.ttl)),
+		Window:         int(atomic.LoadInt32(&conn.window)),
+		DSCP:           int(atomic.LoadInt32(&conn.tos) >> 2),
+		Fragment:       atomic.LoadInt32(&conn.noDF) != 0,
+		InjectRetries:  int(atomic.LoadInt32(&conn.injectRetries)),
+		SeqJitter:      int(atomic.LoadInt32(&conn.seqJitter)),
+		MaxInflight:    atomic.LoadUint32(&conn.maxInflight),
+		ReadLimit:      int(atomic.LoadInt32(&conn.readLimit)),
+		EchoTimestamps: atomic.LoadInt32(&conn.echoTimestamps) != 0,
+		DeliverControl: atomic.LoadInt32(&conn.deliverControl) != 0,
+		EventLog:       int(atomic.LoadInt32(&conn.eventLogSize)),
+	}
+}
+
+// SetOptions validates opts as a whole and applies them to the connection.
+// Nothing is applied if one of them is invalid, or if setting the socket
+// options of DSCP and Fragment fails. All of them are safe to change on a live
+// connection. Writes are held off while applying, so no segment is sent with
+// a mix of old and new settings, the sending side ones take effect from the
+// next segment sent. The settings of the receiving side, ReadLimit,
+// EchoTimestamps and DeliverControl, take effect from the next captured
+// segment. Changing EventLog discards the events recorded.
+func (conn *TCPConn) SetOptions(opts *Options) error {
+	switch {
+	case opts.TTL < 0 || opts.TTL > 255:
+		return errors.New("TTL out of range")
+	case opts.TTL == 1 && conn.dropKernelACKs:
+		return errTTLReserved
+	case opts.Window < 0 || opts.Window > 0xffff:
+		return errors.New("window out of range")
+	case opts.DSCP < 0 || opts.DSCP > 63:
+		return errors.New("DSCP out of range")
+	case opts.InjectRetries < 0 || opts.SeqJitter < 0 || opts.ReadLimit < 0 || opts.EventLog < 0:
+		return errors.New("negative option")
+	}
+
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	// the socket options may fail, roll them back so nothing is applied
+	prevDSCP := int(atomic.LoadInt32(&conn.tos) >> 2)
+	prevDF := atomic.LoadInt32(&conn.noDF) == 0
+	if err := conn.SetDSCP(opts.DSCP); err != nil {
+		conn.SetDSCP(prevDSCP)
+		return err
+	}
+	if err := conn.SetDontFragment(!opts.Fragment); err != nil {
+		conn.SetDontFragment(prevDF)
+		conn.SetDSCP(prevDSCP)
+		return err
+	}
+	atomic.StoreInt32(&conn.ttl, int32(opts.TTL))
+	atomic.StoreInt32(&conn.window, int32(opts.Window))
+	conn.SetInjectRetries(opts.InjectRetries)
+	conn.SetSeqJitter(opts.SeqJitter)
+	conn.SetMaxInflight(opts.MaxInflight)
+	conn.SetReadLimit(opts.ReadLimit)
+	conn.SetEchoTimestamps(opts.EchoTimestamps)
+	conn.SetDeliverControl(opts.DeliverControl)
+	if opts.EventLog != int(atomic.LoadInt32(&conn.eventLogSize)) {
+		conn.SetEventLog(opts.EventLog)
+	}
+	return nil
+}
+
+// SetBPF replaces the generated port filter on the capture sockets with a
+// compiled classic BPF program. The program sees IPv4 packets from the IP
+// header, and IPv6 packets from the TCP header. Segments are still checked
+// against the connection's ports after the filter.
+func (conn *TCPConn) SetBPF(prog []syscall.SockFilter) error {
+	for k := range conn.handles {
+		if err := attachFilter(conn.handles[k], prog); err != nil {
+			return err
+		}
+	}
+	conn.filter.Store(prog)
 	return nil
 }
 
 // SetReadBuffer sets the size of the operating system's receive buffer associated with the connection.
+// The kernel BPF filter, installed before capturing starts, keeps other ports
+// from waking the capture. Raw sockets wake the capture for every matching
+// packet as it arrives, there is no batching window to trade latency for CPU,
+// a larger buffer only absorbs bursts while the capture is busy.
 func (conn *TCPConn) SetReadBuffer(bytes int) error {
 	var err error
 	for k := range conn.handles {
@@ -390,96 +2654,573 @@ func (conn *TCPConn) SetWriteBuffer(bytes int) error {
 // Dial connects to the remote TCP port,
 // and returns a single packet-oriented connection
 func Dial(network, address string) (*TCPConn, error) {
+	return DialContext(context.Background(), network, address)
+}
+
+// DialContext acts like Dial with a context to cancel dialing. When network is
+// "tcp" and the host resolves to both IPv4 and IPv6 addresses, the two address
+// families are raced like the net package does (RFC 6555): the family of the
+// first address starts, the other one follows after a short delay or once the
+// first fails, the first connection established wins and the other is closed.
+func DialContext(ctx context.Context, network, address string) (*TCPConn, error) {
+	return new(Dialer).DialContext(ctx, network, address)
+}
+
+// Dialer contains options for dialing, the zero value dials like Dial.
+type Dialer struct {
+	// ReuseAddr and ReusePort set SO_REUSEADDR and SO_REUSEPORT on the
+	// hijacked kernel socket, so that a local port in TIME_WAIT, or shared by
+	// connections to different remotes, can be bound again.
+	ReuseAddr bool
+	ReusePort bool
+
+	// Logger and Tag are set on the dialed connection from its start,
+	// see SetLogger and SetTag
+	Logger Logger
+	Tag    string
+
+	// DropKernelACKs drops every IPv4 segment sent by the hijacked kernel
+	// socket, i.e. its ACKs of the received datagrams which disagree with the
+	// injected ones, with an iptables rule matching TTL 1. By default only its
+	// resets are dropped on IPv4, the rest expire at the first hop. IPv6 drops
+	// them all already. It requires iptables, the ACKs still leave the host
+	// without it. The injected segments can't use TTL 1 then, SetOptions and
+	// WriteMsg reject it.
+	DropKernelACKs bool
+
+	// HandshakeRetries is the number of extra attempts of the handshake of
+	// the hijacked kernel socket, e.g. while the local address is still in
+	// TIME_WAIT, 0 for a single attempt. The wait between the attempts starts
+	// at HandshakeBackoff, 100ms by default, and doubles every time.
+	HandshakeRetries int
+	HandshakeBackoff time.Duration
+
+	// MinPort and MaxPort constrain the local port of the connection to the
+	// inclusive range, e.g. for egress firewalls, unless the local address
+	// passed to DialAddr has a port. 0 leaves the choice to the kernel.
+	MinPort int
+	MaxPort int
+}
+
+// Dial acts like the package level Dial with the options of d
+func (d *Dialer) Dial(network, address string) (*TCPConn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialAddr acts like the package level DialAddr with the options of d
+func (d *Dialer) DialAddr(network string, laddr, raddr *net.TCPAddr) (*TCPConn, error) {
+	return d.dialAddr(context.Background(), network, laddr, raddr)
+}
+
+// DialContext acts like the package level DialContext with the options of d
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (*TCPConn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+
 	// remote address resolve
-	raddr, err := net.ResolveTCPAddr(network, address)
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		raddr, err := net.ResolveTCPAddr(network, address)
+		if err != nil {
+			return nil, &DialError{StageResolve, err}
+		}
+		return d.dialAddr(ctx, network, nil, raddr)
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, "tcp", service)
+	if err != nil {
+		return nil, &DialError{StageResolve, err}
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
 	if err != nil {
+		return nil, &DialError{StageResolve, err}
+	}
+
+	// split the addresses into the family of the first one and the other
+	var primaries, fallbacks []*net.TCPAddr
+	for _, ip := range ips {
+		v4 := ip.IP.To4() != nil
+		if (network == "tcp4" && !v4) || (network == "tcp6" && v4) {
+			continue
+		}
+		raddr := &net.TCPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+		if len(primaries) == 0 || (primaries[0].IP.To4() != nil) == v4 {
+			primaries = append(primaries, raddr)
+		} else {
+			fallbacks = append(fallbacks, raddr)
+		}
+	}
+	if len(primaries) == 0 {
+		return nil, &DialError{StageResolve, &net.AddrError{Err: "no suitable address found", Addr: host}}
+	}
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, network, primaries)
+	}
+	return d.dialParallel(ctx, network, primaries, fallbacks)
+}
+
+// dialSerial dials the addresses in order until one succeeds,
+// the error of the first address is returned if all fail.
+func (d *Dialer) dialSerial(ctx context.Context, network string, raddrs []*net.TCPAddr) (*TCPConn, error) {
+	var firstErr error
+	for _, raddr := range raddrs {
+		if err := ctx.Err(); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			break
+		}
+		conn, err := d.dialAddr(ctx, network, nil, raddr)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// dialParallel races primaries against fallbacks, which start after
+// fallbackDelay or once primaries failed.
+func (d *Dialer) dialParallel(ctx context.Context, network string, primaries, fallbacks []*net.TCPAddr) (*TCPConn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn *TCPConn
+		err  error
+	}
+	results := make(chan result, 2)
+	race := func(raddrs []*net.TCPAddr) {
+		go func() {
+			conn, err := d.dialSerial(ctx, network, raddrs)
+			results <- result{conn, err}
+		}()
+	}
+
+	race(primaries)
+	pending := 1
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if fallbacks != nil {
+				race(fallbacks)
+				fallbacks = nil
+				pending++
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// close the loser if it gets established regardless of cancel
+				if pending > 0 {
+					go func() {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if fallbacks != nil {
+				race(fallbacks)
+				fallbacks = nil
+				pending++
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// InjectMode is a method to send the datagrams of a connection
+type InjectMode int
+
+// Injection methods reported by AvailableInjectModes
+const (
+	// InjectRawIPv4 sends crafted segments through an IPv4 raw socket in
+	// IP_HDRINCL mode, it requires CAP_NET_RAW, and iptables for the kernel
+	// not to reset the hijacked connection.
+	InjectRawIPv4 InjectMode = iota
+	// InjectRawIPv6 sends crafted segments through an IPv6 raw socket, it
+	// requires CAP_NET_RAW and an IPv6 enabled kernel, and ip6tables as above.
+	InjectRawIPv6
+	// InjectKernelTCP sends through a kernel TCP connection, as DialOrFallback
+	// does, it's always available but the datagram boundaries are lost.
+	InjectKernelTCP
+)
+
+// AvailableInjectModes probes the injection methods usable by this process,
+// by opening and closing raw sockets, so that an application can pick a
+// working path at startup. InjectKernelTCP is always included, last.
+func AvailableInjectModes() []InjectMode {
+	var modes []InjectMode
+	if handle, err := net.ListenIP("ip4:tcp", &net.IPAddr{IP: net.IPv4zero}); err == nil {
+		if setHdrincl(handle) == nil {
+			modes = append(modes, InjectRawIPv4)
+		}
+		handle.Close()
+	}
+	if handle, err := net.ListenIP("ip6:tcp", &net.IPAddr{IP: net.IPv6unspecified}); err == nil {
+		modes = append(modes, InjectRawIPv6)
+		handle.Close()
+	}
+	return append(modes, InjectKernelTCP)
+}
+
+// DialOrFallback dials address with tcpraw, and falls back to a kernel TCP
+// connection if the raw sockets are unavailable, e.g. without CAP_NET_RAW.
+// raw tells which one is returned. Note a fallback connection is a byte stream,
+// it doesn't preserve the boundaries between the payloads written.
+func DialOrFallback(network, address string) (conn net.Conn, raw bool, err error) {
+	c, err := Dial(network, address)
+	if err == nil {
+		return &streamConn{c}, true, nil
+	}
+
+	var de *DialError
+	if !errors.As(err, &de) || de.Stage != StageRawSocket {
+		return nil, false, err
+	}
+	conn, err = net.Dial(network, address)
+	return conn, false, err
+}
+
+// streamConn adapts a dialed TCPConn to net.Conn
+type streamConn struct {
+	*TCPConn
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	return c.WriteTo(p, c.remoteAddr())
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remoteAddr()
+}
+
+// DialAddr acts like Dial but takes resolved addresses, no name resolution
+// is involved. If laddr is nil, a local address is automatically chosen.
+func DialAddr(network string, laddr, raddr *net.TCPAddr) (*TCPConn, error) {
+	return new(Dialer).dialAddr(context.Background(), network, laddr, raddr)
+}
+
+// dialAddr implements DialAddr, the handshake of the hijacked TCP connection
+// is canceled along with ctx.
+func (d *Dialer) dialAddr(ctx context.Context, network string, laddr, raddr *net.TCPAddr) (*TCPConn, error) {
+	if err := checkNetwork(network); err != nil {
 		return nil, err
 	}
+	if raddr == nil {
+		return nil, errors.New("missing remote address")
+	}
+	if (network == "tcp4" && raddr.IP.To4() == nil) || (network == "tcp6" && raddr.IP.To4() != nil) {
+		return nil, &net.AddrError{Err: "mismatched address family", Addr: raddr.String()}
+	}
+	if d.MinPort != 0 || d.MaxPort != 0 {
+		if d.MinPort <= 0 || d.MinPort > d.MaxPort || d.MaxPort > 0xffff {
+			return nil, errors.New("invalid local port range")
+		}
+	}
 
 	// AF_INET
-	handle, err := net.DialIP("ip:tcp", nil, &net.IPAddr{IP: raddr.IP})
+	var lipaddr *net.IPAddr
+	if laddr != nil && laddr.IP != nil {
+		lipaddr = &net.IPAddr{IP: laddr.IP, Zone: laddr.Zone}
+	}
+	handle, err := net.DialIP(rawNetwork(raddr.IP), lipaddr, &net.IPAddr{IP: raddr.IP, Zone: raddr.Zone})
 	if err != nil {
-		return nil, err
+		return nil, &DialError{StageRawSocket, err}
 	}
+	if err := setHdrincl(handle); err != nil {
+		handle.Close()
+		return nil, &DialError{StageRawSocket, err}
+	}
+	setRxqOvfl(handle)
+	setRecvIPv6Control(handle)
 
 	// create an established tcp connection
 	// will hack this tcp connection for packet transmission
-	tcpconn, err := net.DialTCP(network, nil, raddr)
+	dialer := net.Dialer{Control: d.control}
+	if laddr != nil {
+		dialer.LocalAddr = laddr
+	}
+	if d.MinPort != 0 && (laddr == nil || laddr.Port == 0) {
+		// bind in the control function, the dialer mustn't bind again
+		var lip net.IP
+		if laddr != nil {
+			lip = laddr.IP
+		}
+		dialer.LocalAddr = nil
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			if err := d.control(network, address, c); err != nil {
+				return err
+			}
+			var err error
+			c.Control(func(fd uintptr) {
+				_, err = bindPortInRange(int(fd), lip, raddr.IP.To4() != nil, d.MinPort, d.MaxPort)
+			})
+			return err
+		}
+	}
+	c, err := d.handshake(ctx, &dialer, network, raddr.String())
 	if err != nil {
-		return nil, err
+		handle.Close()
+		return nil, &DialError{StageHandshake, err}
+	}
+	return d.hijack(handle, c.(*net.TCPConn))
+}
+
+// Hijack takes over the established tcpconn, e.g. dialed through a proxy or
+// a custom dialer, and returns a packet-oriented connection to its remote
+// address as Dial does. tcpconn mustn't be used by the caller afterwards.
+// If the raw socket can't be opened, tcpconn is left intact and the error
+// has StageRawSocket, otherwise tcpconn is closed on failure. With
+// CAP_NET_ADMIN the sequence numbers are read in TCP repair mode, which
+// fails on kernels lacking TCP_REPAIR_OFF_NO_WP.
+func Hijack(tcpconn *net.TCPConn) (*TCPConn, error) {
+	return new(Dialer).Hijack(tcpconn)
+}
+
+// Hijack acts like the package level Hijack with the options of d, the ones
+// about dialing don't apply.
+func (d *Dialer) Hijack(tcpconn *net.TCPConn) (*TCPConn, error) {
+	laddr, ok := tcpconn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("not a connected TCP socket")
+	}
+	raddr, ok := tcpconn.RemoteAddr().(*net.TCPAddr)
+	if !ok || raddr == nil {
+		return nil, errors.New("not a connected TCP socket")
+	}
+
+	handle, err := net.DialIP(rawNetwork(raddr.IP), &net.IPAddr{IP: laddr.IP, Zone: laddr.Zone}, &net.IPAddr{IP: raddr.IP, Zone: raddr.Zone})
+	if err != nil {
+		return nil, &DialError{StageRawSocket, err}
+	}
+	if err := setHdrincl(handle); err != nil {
+		handle.Close()
+		return nil, &DialError{StageRawSocket, err}
 	}
+	setRxqOvfl(handle)
+	setRecvIPv6Control(handle)
+	return d.hijack(handle, tcpconn)
+}
+
+// hijack turns the established tcpconn into a TCPConn injecting through
+// handle, both are closed on failure.
+func (d *Dialer) hijack(handle *net.IPConn, tcpconn *net.TCPConn) (*TCPConn, error) {
+	raddr := tcpconn.RemoteAddr().(*net.TCPAddr)
 
 	// fields
-	conn := new(TCPConn)
-	conn.die = make(chan struct{})
-	conn.flowTable = make(map[string]*tcpFlow)
+	conn := newTCPConn()
+	conn.SetLogger(d.Logger)
+	conn.SetTag(d.Tag)
 	conn.tcpconn = tcpconn
-	conn.chMessage = make(chan message)
-	conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) { e.conn = tcpconn })
+	conn.raddr = tcpconn.RemoteAddr().(*net.TCPAddr)
 	conn.handles = append(conn.handles, handle)
-	conn.opts = gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+
+	// the kernel socket is silenced before the repair mode is entered, as
+	// leaving it may emit a segment
+	err := setTTL(tcpconn, 1)
+	if err != nil {
+		conn.log().Errorf("hijacking %v: %v", raddr, err)
+		conn.Close()
+		return nil, &DialError{StageHijack, err}
+	}
+	if err = quiesce(tcpconn); err != nil {
+		conn.log().Errorf("hijacking %v: %v", raddr, err)
+		conn.Close()
+		return nil, &DialError{StageHijack, err}
+	}
+
+	// without the repair mode the sequence numbers are learned from the
+	// captured segments, the SYN-ACK of a dialed connection at least
+	snd, rcv, seqErr := d.queueSeqs(tcpconn)
+	if seqErr == errRepairMode {
+		conn.log().Errorf("hijacking %v: %v", raddr, seqErr)
+		conn.Close()
+		return nil, &DialError{StageHijack, seqErr}
+	}
+	conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) {
+		e.conn = tcpconn
+		if seqErr == nil {
+			e.seq, e.ack = uint64(snd), uint64(rcv)
+			e.acked = e.seq
+			e.handle = handle
+		}
+	})
+	if seqErr == nil {
+		conn.syncedOnce.Do(func() { close(conn.synced) })
+	}
+	conn.lport = int32(tcpconn.LocalAddr().(*net.TCPAddr).Port)
+	conn.rport = int32(conn.raddr.Port)
+	conn.dropKernelACKs = d.DropKernelACKs
+	setFilter(handle, conn.localPort())
+	go conn.captureFlow(handle)
+	go conn.cleaner()
+
+	// writes are dropped until the flow is synced, don't return before, the
+	// SYN-ACK of a dialed connection is queued on the handle already
+	select {
+	case <-conn.synced:
+	case <-time.After(syncTimeout):
+		conn.log().Warnf("no segment captured from %v, writes are dropped until one is", raddr)
+	}
+
+	conn.installDialRules(raddr)
+
+	// discard everything
+	conn.discard(tcpconn)
+
+	return conn, nil
+}
+
+// handshake dials the kernel socket with dialer, retrying as configured in d
+func (d *Dialer) handshake(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	backoff := d.HandshakeBackoff
+	if backoff <= 0 {
+		backoff = defaultMinBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		c, err := dialer.DialContext(ctx, network, address)
+		if err == nil || attempt >= d.HandshakeRetries || ctx.Err() != nil {
+			return c, err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// control applies the socket options of d to the kernel socket before it binds
+func (d *Dialer) control(network, address string, c syscall.RawConn) error {
+	var err error
+	c.Control(func(fd uintptr) {
+		if d.ReuseAddr {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+				return
+			}
+		}
+		if d.ReusePort {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}
+	})
+	return err
+}
+
+// DialReadOnly opens a receive-only connection capturing the flow between
+// laddr and raddr, both with ports, laddr.IP may be nil for any local address.
+// No kernel socket is created and no handshake takes place, the flow state is
+// learned from the captured segments, and nothing is changed in iptables.
+// Writes return ErrReadOnly.
+func DialReadOnly(network string, laddr, raddr *net.TCPAddr) (*TCPConn, error) {
+	if err := checkNetwork(network); err != nil {
+		return nil, err
+	}
+	if laddr == nil || raddr == nil || laddr.Port == 0 || raddr.Port == 0 {
+		return nil, errors.New("missing address or port")
+	}
+	if (network == "tcp4" && raddr.IP.To4() == nil) || (network == "tcp6" && raddr.IP.To4() != nil) {
+		return nil, &net.AddrError{Err: "mismatched address family", Addr: raddr.String()}
 	}
-	go conn.captureFlow(handle, tcpconn.LocalAddr().(*net.TCPAddr).Port)
-	go conn.cleaner()
 
-	// iptables
-	err = setTTL(tcpconn, 1)
+	var lipaddr *net.IPAddr
+	if laddr.IP != nil {
+		lipaddr = &net.IPAddr{IP: laddr.IP, Zone: laddr.Zone}
+	}
+	handle, err := net.DialIP(rawNetwork(raddr.IP), lipaddr, &net.IPAddr{IP: raddr.IP, Zone: raddr.Zone})
 	if err != nil {
-		return nil, err
+		return nil, &DialError{StageRawSocket, err}
 	}
+	setRxqOvfl(handle)
+	setRecvIPv6Control(handle)
 
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4); err == nil {
-		rule := []string{"-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port),"--tcp-flags","RST","RST", "-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.iprule = rule
-					conn.iptables = ipt
-				}
-			}
-		}
+	// fields
+	conn := newTCPConn()
+	conn.readOnly = true
+	conn.raddr = raddr
+	conn.lport = int32(laddr.Port)
+	conn.rport = int32(raddr.Port)
+	conn.handles = append(conn.handles, handle)
+	setFilter(handle, conn.localPort())
+	go conn.captureFlow(handle)
+	go conn.cleaner()
+	return conn, nil
+}
+
+// installDialRules installs the iptables rules of a dialed connection to raddr
+func (conn *TCPConn) installDialRules(raddr *net.TCPAddr) {
+	iprule := []string{"-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "--tcp-flags", "RST", "RST", "-j", "DROP"}
+	if ipt := appendRule(iptables.ProtocolIPv4, iprule); ipt != nil {
+		conn.iprule = iprule
+		conn.iptables = ipt
+	} else {
+		conn.log().Warnf("iptables rule dropping RST to %v not installed", raddr)
 	}
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err == nil {
-		rule := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.ip6rule = rule
-					conn.ip6tables = ipt
-				}
-			}
+	ip6rule := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
+	if ipt := appendRule(iptables.ProtocolIPv6, ip6rule); ipt != nil {
+		conn.ip6rule = ip6rule
+		conn.ip6tables = ipt
+	} else {
+		conn.log().Warnf("ip6tables rule dropping hop limit 1 to %v not installed", raddr)
+	}
+	if conn.dropKernelACKs && raddr.IP.To4() != nil {
+		ttlrule := []string{"-m", "ttl", "--ttl-eq", "1", "-p", "tcp", "-d", raddr.IP.String(), "--dport", fmt.Sprint(raddr.Port), "-j", "DROP"}
+		if ipt := appendRule(iptables.ProtocolIPv4, ttlrule); ipt != nil {
+			conn.ttlrule = ttlrule
+			conn.ttltables = ipt
+		} else {
+			conn.log().Warnf("iptables rule dropping TTL 1 to %v not installed", raddr)
 		}
 	}
-
-	// discard everything
-	go io.Copy(ioutil.Discard, tcpconn)
-
-	return conn, nil
 }
 
 // Listen acts like net.ListenTCP,
 // and returns a single packet-oriented connection
+//
+// The clients are served by one connection: ReadFrom returns the datagrams
+// of all of them with the source address of each, and WriteTo(p, addr)
+// sends p on the flow of addr. A client becomes a flow once its kernel
+// connection is accepted, see SetAcceptFunc, segments captured from other
+// addresses are not delivered. The first datagrams of a client overtaking
+// the accepting are held briefly until then, and dropped if it's rejected.
 func Listen(network, address string) (*TCPConn, error) {
-	// fields
-	conn := new(TCPConn)
-	conn.flowTable = make(map[string]*tcpFlow)
-	conn.die = make(chan struct{})
-	conn.chMessage = make(chan message)
-	conn.opts = gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+	if err := checkNetwork(network); err != nil {
+		return nil, err
 	}
 
+	// fields
+	conn := newTCPConn()
+
 	// resolve address
 	laddr, err := net.ResolveTCPAddr(network, address)
 	if err != nil {
 		return nil, err
 	}
+	conn.lport = int32(laddr.Port)
 
 	// AF_INET
-	ifaces, err := net.Interfaces()
+	ifaces, err := ListInterfaces()
 	if err != nil {
 		return nil, err
 	}
@@ -487,26 +3228,46 @@ func Listen(network, address string) (*TCPConn, error) {
 	if laddr.IP == nil || laddr.IP.IsUnspecified() { // if address is not specified, capture on all ifaces
 		var lasterr error
 		for _, iface := range ifaces {
-			if addrs, err := iface.Addrs(); err == nil {
-				for _, addr := range addrs {
-					if ipaddr, ok := addr.(*net.IPNet); ok {
-						if handle, err := net.ListenIP("ip:tcp", &net.IPAddr{IP: ipaddr.IP}); err == nil {
-							conn.handles = append(conn.handles, handle)
-							go conn.captureFlow(handle, laddr.Port)
-						} else {
+			for _, addr := range iface.Addrs {
+				if ip := addrIP(addr, network); ip != nil {
+					ipaddr := &net.IPAddr{IP: ip}
+					if ip.IsLinkLocalUnicast() && ip.To4() == nil { // link-local IPv6 needs a zone to bind
+						ipaddr.Zone = iface.Name
+					}
+					if handle, err := net.ListenIP(rawNetwork(ip), ipaddr); err == nil {
+						if err := setHdrincl(handle); err != nil {
+							handle.Close()
 							lasterr = err
+							continue
 						}
+						setRxqOvfl(handle)
+						setRecvIPv6Control(handle)
+						setFilter(handle, laddr.Port)
+						conn.handles = append(conn.handles, handle)
+						go conn.captureFlow(handle)
+					} else {
+						lasterr = err
 					}
 				}
 			}
 		}
 		if len(conn.handles) == 0 {
+			if lasterr == nil {
+				lasterr = &net.AddrError{Err: "no suitable address found", Addr: address}
+			}
 			return nil, lasterr
 		}
 	} else {
-		if handle, err := net.ListenIP("ip:tcp", &net.IPAddr{IP: laddr.IP}); err == nil {
+		if handle, err := net.ListenIP(rawNetwork(laddr.IP), &net.IPAddr{IP: laddr.IP}); err == nil {
+			if err := setHdrincl(handle); err != nil {
+				handle.Close()
+				return nil, err
+			}
+			setRxqOvfl(handle)
+			setRecvIPv6Control(handle)
+			setFilter(handle, laddr.Port)
 			conn.handles = append(conn.handles, handle)
-			go conn.captureFlow(handle, laddr.Port)
+			go conn.captureFlow(handle)
 		} else {
 			return nil, err
 		}
@@ -526,53 +3287,336 @@ func Listen(network, address string) (*TCPConn, error) {
 	// iptables drop packets marked with TTL = 1
 	// TODO: what if iptables is not available, the next hop will send back ICMP Time Exceeded,
 	// is this still an acceptable behavior?
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4); err == nil {
-		rule := []string{"-p", "tcp", "--sport", fmt.Sprint(laddr.Port),"--tcp-flags","RST","RST","-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.iprule = rule
-					conn.iptables = ipt
-				}
-			}
-		}
+	iprule := []string{"-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "--tcp-flags", "RST", "RST", "-j", "DROP"}
+	if ipt := appendRule(iptables.ProtocolIPv4, iprule); ipt != nil {
+		conn.iprule = iprule
+		conn.iptables = ipt
 	}
-	if ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6); err == nil {
-		rule := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
-		if exists, err := ipt.Exists("filter", "OUTPUT", rule...); err == nil {
-			if !exists {
-				if err = ipt.Append("filter", "OUTPUT", rule...); err == nil {
-					conn.ip6rule = rule
-					conn.ip6tables = ipt
-				}
-			}
-		}
+	ip6rule := []string{"-m", "hl", "--hl-eq", "1", "-p", "tcp", "--sport", fmt.Sprint(laddr.Port), "-j", "DROP"}
+	if ipt := appendRule(iptables.ProtocolIPv6, ip6rule); ipt != nil {
+		conn.ip6rule = ip6rule
+		conn.ip6tables = ipt
 	}
 
 	// discard everything in original connection
+	conn.wg.Add(1)
 	go func() {
+		defer conn.wg.Done()
 		for {
 			tcpconn, err := l.AcceptTCP()
 			if err != nil {
 				return
 			}
 
+			// rejected before hijacking, so the kernel closes it normally
+			if f, _ := conn.accept.Load().(AcceptFunc); f != nil && !f(tcpconn.RemoteAddr()) {
+				conn.log().Debugf("client %v rejected", tcpconn.RemoteAddr())
+				tcpconn.Close()
+				conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) {
+					conn.dropPending(e)
+					e.rejected = true
+				})
+				continue
+			}
+
 			// if we cannot set TTL = 1, the only thing reasonable is panic
 			if err := setTTL(tcpconn, 1); err != nil {
 				panic(err)
 			}
+			quiesce(tcpconn)
+
+			// record net.Conn, unless Close has already swept the flows
+			var closed bool
+			var pending []message
+			conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) {
+				select {
+				case <-conn.die:
+					closed = true
+					return
+				default:
+				}
+				if e.conn != nil && e.conn != tcpconn { // stale connection of a reused 4-tuple
+					e.conn.Close()
+				}
+				e.conn = tcpconn
+				e.rejected = false
+				if time.Since(e.pendingTs) <= pendingTimeout {
+					pending = e.pending
+				}
+				conn.dropPending(e)
+			})
+			if closed {
+				tcpconn.Close()
+				return
+			}
 
-			// record net.Conn
-			conn.lockflow(tcpconn.RemoteAddr(), func(e *tcpFlow) { e.conn = tcpconn })
+			// deliver the datagrams which overtook the accepting
+			for _, packet := range pending {
+				conn.broadcast(Datagram{packet.bts, packet.addr, packet.meta, packet.truncated})
+				if !conn.enqueue(packet) {
+					return
+				}
+			}
 
 			// discard everything
-			go io.Copy(ioutil.Discard, tcpconn)
+			conn.discard(tcpconn)
 		}
 	}()
 
 	return conn, nil
 }
 
+// InterfaceInfo describes a network interface considered for capturing
+type InterfaceInfo struct {
+	Name  string
+	Index int
+	MTU   int
+	Flags net.Flags
+	Addrs []net.Addr
+}
+
+// the cached interface enumeration shared by all connections
+var (
+	ifaceLock    sync.Mutex
+	ifaceCache   []InterfaceInfo
+	ifaceExpires time.Time
+)
+
+// ListInterfaces returns the network interfaces and their addresses which
+// Listen inspects to open capture sockets, for diagnosing setup failures.
+// The enumeration is cached for a short while, see RefreshInterfaces.
+func ListInterfaces() ([]InterfaceInfo, error) {
+	ifaceLock.Lock()
+	defer ifaceLock.Unlock()
+	if ifaceCache == nil || time.Now().After(ifaceExpires) {
+		if err := refreshInterfaces(); err != nil {
+			return nil, err
+		}
+	}
+	infos := make([]InterfaceInfo, len(ifaceCache))
+	copy(infos, ifaceCache)
+	return infos, nil
+}
+
+// RefreshInterfaces re-enumerates the network interfaces immediately,
+// it should be called when the network configuration is known to have changed.
+func RefreshInterfaces() error {
+	ifaceLock.Lock()
+	defer ifaceLock.Unlock()
+	return refreshInterfaces()
+}
+
+// refreshInterfaces fills the interface cache, ifaceLock must be held
+func refreshInterfaces() error {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	infos := make([]InterfaceInfo, 0, len(ifaces))
+	for _, iface := range ifaces {
+		info := InterfaceInfo{Name: iface.Name, Index: iface.Index, MTU: iface.MTU, Flags: iface.Flags}
+		if addrs, err := iface.Addrs(); err == nil {
+			info.Addrs = addrs
+		}
+		infos = append(infos, info)
+	}
+	ifaceCache = infos
+	ifaceExpires = time.Now().Add(interfaceCacheTTL)
+	return nil
+}
+
+// SendRST injects a single RST segment with sequence number seq from laddr to
+// raddr, without a connection. Both addresses need an IP and a port.
+func SendRST(laddr, raddr *net.TCPAddr, seq uint32) error {
+	if laddr == nil || raddr == nil || laddr.IP == nil || raddr.IP == nil {
+		return errors.New("missing address")
+	}
+	if (laddr.IP.To4() == nil) != (raddr.IP.To4() == nil) {
+		return &net.AddrError{Err: "mismatched address family", Addr: raddr.String()}
+	}
+	for _, addr := range []*net.TCPAddr{laddr, raddr} {
+		if addr.Port < 1 || addr.Port > 0xffff {
+			return &net.AddrError{Err: "invalid port", Addr: addr.String()}
+		}
+	}
+
+	handle, err := net.ListenIP(rawNetwork(laddr.IP), &net.IPAddr{IP: laddr.IP, Zone: laddr.Zone})
+	if err != nil {
+		return &DialError{StageRawSocket, err}
+	}
+	defer handle.Close()
+	if err := setHdrincl(handle); err != nil {
+		return &DialError{StageRawSocket, err}
+	}
+
+	// a scratch connection and flow to go through the regular output path
+	conn := newTCPConn()
+	conn.lport = int32(laddr.Port)
+	e := new(tcpFlow)
+	e.handle = handle
+	e.seq = uint64(seq)
+	e.tcpHeader.RST = true
+	return conn.output(e, raddr, nil, SendMeta{})
+}
+
+// CheckInterface verifies that raw capture works on the interface having
+// localIP assigned: a raw socket can be opened on it, switched to IP_HDRINCL
+// for IPv4, and given a BPF filter. Nothing is kept open, it's meant as a
+// health check failing fast at startup.
+func CheckInterface(localIP net.IP) error {
+	if interfaceByIP(localIP) == nil {
+		return &net.AddrError{Err: "no interface with address", Addr: localIP.String()}
+	}
+
+	handle, err := net.ListenIP(rawNetwork(localIP), &net.IPAddr{IP: localIP})
+	if err != nil {
+		return &DialError{StageRawSocket, err}
+	}
+	defer handle.Close()
+	if err := setHdrincl(handle); err != nil {
+		return &DialError{StageRawSocket, err}
+	}
+	if err := setFilter(handle, 0); err != nil {
+		return &DialError{StageRawSocket, err}
+	}
+	return nil
+}
+
+// interfaceByIP finds the network interface which has the given address assigned
+func interfaceByIP(ip net.IP) *InterfaceInfo {
+	ifaces, err := ListInterfaces()
+	if err != nil {
+		return nil
+	}
+	network := "tcp6"
+	if ip.To4() != nil {
+		network = "tcp4"
+	}
+	for k := range ifaces {
+		for _, addr := range ifaces[k].Addrs {
+			if ifip := addrIP(addr, network); ifip != nil && ifip.Equal(ip) {
+				return &ifaces[k]
+			}
+		}
+	}
+	return nil
+}
+
+// addrIP returns the IP of an interface address if it's usable for network,
+// it skips the entries without an IP, unspecified and of the other family.
+func addrIP(addr net.Addr, network string) net.IP {
+	ipnet, ok := addr.(*net.IPNet)
+	if !ok || ipnet.IP == nil || ipnet.IP.IsUnspecified() {
+		return nil
+	}
+	v4 := ipnet.IP.To4() != nil
+	if (network == "tcp4" && !v4) || (network == "tcp6" && v4) {
+		return nil
+	}
+	return ipnet.IP
+}
+
+// checkNetwork validates the network argument, only TCP networks are supported.
+// "tcp4" and "tcp6" restrict the addresses to one family, "tcp" takes the
+// family of the resolved address.
+func checkNetwork(network string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return nil
+	}
+	return net.UnknownNetworkError(network)
+}
+
+// rawNetwork returns the network of the raw socket serving ip's family
+func rawNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip4:tcp"
+	}
+	return "ip6:tcp"
+}
+
+// unwrapSeq extends a 32-bit sequence number v to 64 bits,
+// choosing the value nearest to the previous extended value prev.
+func unwrapSeq(prev uint64, v uint32) uint64 {
+	delta := int64(int32(v - uint32(prev)))
+	if delta < 0 && uint64(-delta) > prev { // cannot go below zero
+		return uint64(v)
+	}
+	return prev + uint64(delta)
+}
+
+// parseTimestamp extracts TSval and TSecr from the TCP timestamp option
+func parseTimestamp(tcp *layers.TCP) (tsval, tsecr uint32, ok bool) {
+	for _, opt := range tcp.Options {
+		if opt.OptionType == layers.TCPOptionKindTimestamps && len(opt.OptionData) == 8 {
+			return binary.BigEndian.Uint32(opt.OptionData), binary.BigEndian.Uint32(opt.OptionData[4:]), true
+		}
+	}
+	return 0, 0, false
+}
+
+// quiesce keeps the hijacked kernel socket from emitting segments of its own.
+// Nothing is ever written to it, and TCP_NODELAY is set so that no data could
+// linger in the send queue waiting for Nagle to release it later. Keepalive,
+// which the net package enables by default, is turned off. Window probes are
+// only sent for queued data, so an empty send queue suppresses them as well.
+func quiesce(c *net.TCPConn) error {
+	if err := c.SetNoDelay(true); err != nil {
+		return err
+	}
+	return c.SetKeepAlive(false)
+}
+
+// queueSeqs returns the next sequence numbers to send and to receive on c,
+// read in TCP repair mode, which requires CAP_NET_ADMIN. The repair mode is
+// left with TCP_REPAIR_OFF_NO_WP so that the kernel sends no window probe, on
+// kernels lacking it c is left in repair mode and unusable, errRepairMode is
+// returned. Leaving the repair mode resets SO_REUSEADDR, the socket options
+// of d are applied again.
+func (d *Dialer) queueSeqs(c *net.TCPConn) (snd, rcv uint32, err error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var repaired bool
+	cerr := raw.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpRepair, 1); err != nil {
+			return
+		}
+		defer func() {
+			if syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpRepair, tcpRepairOffNoWP) != nil {
+				err = errRepairMode
+				return
+			}
+			repaired = true
+		}()
+
+		var v int
+		for _, q := range []struct {
+			queue int
+			seq   *uint32
+		}{{tcpSendQueue, &snd}, {tcpRecvQueue, &rcv}} {
+			if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpRepairQueue, q.queue); err != nil {
+				return
+			}
+			if v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpQueueSeq); err != nil {
+				return
+			}
+			*q.seq = uint32(v)
+		}
+	})
+	if cerr != nil {
+		return 0, 0, cerr
+	}
+	if repaired {
+		if rerr := d.control("", "", raw); rerr != nil {
+			return 0, 0, rerr
+		}
+	}
+	return snd, rcv, err
+}
+
 // setTTL sets the Time-To-Live field on a given connection
 func setTTL(c *net.TCPConn, ttl int) error {
 	raw, err := c.SyscallConn()
@@ -612,3 +3656,282 @@ func setDSCP(c *net.IPConn, dscp int) error {
 	}
 	return err
 }
+
+// setHdrincl enables IP_HDRINCL on IPv4 raw sockets so that the IP header is
+// built by us, it's a no-op for IPv6 raw sockets.
+func setHdrincl(c *net.IPConn) error {
+	if c.LocalAddr().(*net.IPAddr).IP.To4() == nil {
+		return nil
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_HDRINCL, 1)
+	})
+	return err
+}
+
+// txChecksumOffload queries the TX checksum offload of the interface name
+func txChecksumOffload(name string) (bool, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return false, err
+	}
+	defer syscall.Close(fd)
+
+	// struct ethtool_value and struct ifreq pointing to it
+	value := struct{ cmd, data uint32 }{cmd: ethtoolGTxCsum}
+	var ifr struct {
+		name [syscall.IFNAMSIZ]byte
+		data unsafe.Pointer
+		_    [16]byte
+	}
+	copy(ifr.name[:], name)
+	ifr.data = unsafe.Pointer(&value)
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&ifr)))
+	if errno == syscall.EOPNOTSUPP {
+		return false, nil
+	} else if errno != 0 {
+		return false, errno
+	}
+	return value.data != 0, nil
+}
+
+// setRxqOvfl enables SO_RXQ_OVFL on a raw socket, the kernel will attach the
+// number of packets dropped on this socket to every received message.
+func setRxqOvfl(c *net.IPConn) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1)
+	})
+	return err
+}
+
+// parseDrops extracts the SO_RXQ_OVFL drop counter from control messages
+func parseDrops(oob []byte) (uint32, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SO_RXQ_OVFL && len(m.Data) >= 4 {
+			return *(*uint32)(unsafe.Pointer(&m.Data[0])), true // host byte order
+		}
+	}
+	return 0, false
+}
+
+// setRecvIPv6Control enables IPV6_RECVHOPLIMIT and IPV6_RECVTCLASS on IPv6 raw
+// sockets, the kernel will attach the hop limit and the traffic class to every
+// received message, it's a no-op for IPv4.
+func setRecvIPv6Control(c *net.IPConn) error {
+	if c.LocalAddr().(*net.IPAddr).IP.To4() != nil {
+		return nil
+	}
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	raw.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVHOPLIMIT, 1); err != nil {
+			return
+		}
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1)
+	})
+	return err
+}
+
+// parseIPv6Control extracts the value of the IPv6 control message typ, like
+// IPV6_HOPLIMIT or IPV6_TCLASS, from control messages
+func parseIPv6Control(oob []byte, typ int32) (uint8, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == typ && len(m.Data) >= 4 {
+			return uint8(*(*int32)(unsafe.Pointer(&m.Data[0]))), true // host byte order
+		}
+	}
+	return 0, false
+}
+
+// setDF sets the path MTU discovery mode to control the Don't-Fragment flag
+func setDF(c *net.IPConn, df bool) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	addr := c.LocalAddr().(*net.IPAddr)
+
+	if addr.IP.To4() == nil {
+		mode := syscall.IPV6_PMTUDISC_DO
+		if !df {
+			mode = syscall.IPV6_PMTUDISC_DONT
+		}
+		raw.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, mode)
+		})
+	} else {
+		mode := syscall.IP_PMTUDISC_DO
+		if !df {
+			mode = syscall.IP_PMTUDISC_DONT
+		}
+		raw.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, mode)
+		})
+	}
+	return err
+}
+
+// setFilter attaches a BPF program to the raw socket to accept only the TCP
+// segments destined to port, so unrelated traffic is dropped in the kernel
+// instead of waking up captureFlow.
+func setFilter(c *net.IPConn, port int) error {
+	var prog []syscall.SockFilter
+	if c.LocalAddr().(*net.IPAddr).IP.To4() != nil {
+		// IPv4 raw sockets see the IP header, skip it by IHL
+		prog = []syscall.SockFilter{
+			*syscall.LsfStmt(syscall.BPF_LDX|syscall.BPF_B|syscall.BPF_MSH, 0),
+			*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_IND, 2),
+			*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, port, 0, 1),
+			*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, maxPacketSize),
+			*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, 0),
+		}
+	} else {
+		// IPv6 raw sockets start at the TCP header
+		prog = []syscall.SockFilter{
+			*syscall.LsfStmt(syscall.BPF_LD|syscall.BPF_H|syscall.BPF_ABS, 2),
+			*syscall.LsfJump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, port, 0, 1),
+			*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, maxPacketSize),
+			*syscall.LsfStmt(syscall.BPF_RET|syscall.BPF_K, 0),
+		}
+	}
+	return attachFilter(c, prog)
+}
+
+// attachFilter installs a classic BPF program on the raw socket
+func attachFilter(c *net.IPConn, prog []syscall.SockFilter) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	raw.Control(func(fd uintptr) {
+		err = syscall.AttachLsf(int(fd), prog)
+	})
+	return err
+}
+
+// sendControl builds the ancillary data carrying the per-packet settings
+// for IPv6 handles, IPv4 handles have them set in the IP header directly.
+func sendControl(meta SendMeta) []byte {
+	var oob []byte
+	if meta.TTL > 0 {
+		oob = appendControl(oob, syscall.IPPROTO_IPV6, syscall.IPV6_HOPLIMIT, meta.TTL)
+	}
+	if meta.DSCP > 0 {
+		oob = appendControl(oob, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, meta.DSCP)
+	}
+	return oob
+}
+
+// writeConnected sends b along with oob on the connected raw socket of a
+// dialed connection, WriteMsgIP rejects connected sockets whatever the address.
+func writeConnected(handle packetHandle, b, oob []byte) error {
+	c, ok := handle.(*net.IPConn)
+	if !ok {
+		_, _, err := handle.WriteMsgIP(b, oob, nil)
+		return err
+	}
+	if len(oob) == 0 {
+		_, err := c.Write(b)
+		return err
+	}
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Write(func(fd uintptr) bool {
+		serr = syscall.Sendmsg(int(fd), b, oob, nil, 0)
+		return serr != syscall.EAGAIN
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		// wrapped in a *net.OpError by the writer
+		return os.NewSyscallError("sendmsg", err)
+	}
+	return nil
+}
+
+// appendControl appends a control message with an int value to oob
+func appendControl(oob []byte, level, typ, value int) []byte {
+	b := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(4))
+	*(*int32)(unsafe.Pointer(&b[syscall.CmsgLen(0)])) = int32(value)
+	return append(oob, b...)
+}
+
+// bindPortInRange binds an unconnected socket to ip, or any address if nil,
+// and a free port in [min, max] tried from a random start, and returns it.
+func bindPortInRange(fd int, ip net.IP, v4 bool, min, max int) (int, error) {
+	var r uint32
+	binary.Read(rand.Reader, binary.LittleEndian, &r)
+	n := max - min + 1
+	start := int(r % uint32(n))
+	for i := 0; i < n; i++ {
+		port := min + (start+i)%n
+		var sa syscall.Sockaddr
+		if v4 {
+			sa4 := &syscall.SockaddrInet4{Port: port}
+			copy(sa4.Addr[:], ip.To4())
+			sa = sa4
+		} else {
+			sa6 := &syscall.SockaddrInet6{Port: port}
+			copy(sa6.Addr[:], ip.To16())
+			sa = sa6
+		}
+		err := syscall.Bind(fd, sa)
+		if err == nil {
+			return port, nil
+		}
+		if err != syscall.EADDRINUSE {
+			return 0, err
+		}
+	}
+	return 0, syscall.EADDRINUSE
+}
+
+// bindAnyPort binds an unconnected socket to an ephemeral port and returns it
+func bindAnyPort(fd int, v4 bool) (int, error) {
+	var sa syscall.Sockaddr = &syscall.SockaddrInet6{}
+	if v4 {
+		sa = &syscall.SockaddrInet4{}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return 0, err
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return 0, err
+	}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return sa.Port, nil
+	case *syscall.SockaddrInet6:
+		return sa.Port, nil
+	}
+	return 0, errors.New("unknown socket address")
+}
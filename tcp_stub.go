@@ -3,8 +3,10 @@
 package tcpraw
 
 import (
+	"context"
 	"errors"
 	"net"
+	"time"
 )
 
 type TCPConn struct{ *net.UDPConn }
@@ -15,6 +17,174 @@ func Dial(network, address string) (*TCPConn, error) {
 	return nil, errors.New("os not supported")
 }
 
+// Stages of dialing reported by DialError
+const (
+	StageResolve   = "resolve address"
+	StageRawSocket = "open raw socket"
+	StageHandshake = "dial tcp"
+	StageHijack    = "hijack tcp"
+)
+
+// DialError tells which stage of dialing failed
+type DialError struct {
+	Stage string
+	Err   error
+}
+
+func (e *DialError) Error() string { return "tcpraw: " + e.Stage + ": " + e.Err.Error() }
+func (e *DialError) Unwrap() error { return e.Err }
+
+// DialContext acts like Dial with a context to cancel dialing
+func DialContext(ctx context.Context, network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+// Dialer contains options for dialing
+type Dialer struct {
+	ReuseAddr bool
+	ReusePort bool
+	Logger    Logger
+	Tag       string
+
+	DropKernelACKs bool
+
+	HandshakeRetries int
+	HandshakeBackoff time.Duration
+
+	MinPort int
+	MaxPort int
+}
+
+// Logger receives the diagnostics of a connection
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// Dial acts like the package level Dial with the options of d
+func (d *Dialer) Dial(network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+// DialAddr acts like the package level DialAddr with the options of d
+func (d *Dialer) DialAddr(network string, laddr, raddr *net.TCPAddr) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+// DialContext acts like the package level DialContext with the options of d
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+// Hijack takes over the established tcpconn
+func Hijack(tcpconn *net.TCPConn) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+// Hijack acts like the package level Hijack with the options of d
+func (d *Dialer) Hijack(tcpconn *net.TCPConn) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+// InjectMode is a method to send the datagrams of a connection
+type InjectMode int
+
+// Injection methods reported by AvailableInjectModes
+const (
+	InjectRawIPv4 InjectMode = iota
+	InjectRawIPv6
+	InjectKernelTCP
+)
+
+// AvailableInjectModes reports the kernel TCP connection only, raw sockets are unavailable
+func AvailableInjectModes() []InjectMode {
+	return []InjectMode{InjectKernelTCP}
+}
+
+// DialOrFallback dials address with a kernel TCP connection, raw sockets are unavailable
+func DialOrFallback(network, address string) (conn net.Conn, raw bool, err error) {
+	conn, err = net.Dial(network, address)
+	return conn, false, err
+}
+
+// DialAddr acts like Dial but takes resolved addresses
+func DialAddr(network string, laddr, raddr *net.TCPAddr) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+// RetryPolicy controls how AutoConn re-dials
+type RetryPolicy struct {
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	MaxRetries int
+}
+
+// AutoConn is a dialed connection which re-dials the remote address
+type AutoConn struct{ *net.UDPConn }
+
+// DialAuto dials address like Dial, and re-dials it under policy
+func DialAuto(network, address string, policy RetryPolicy) (*AutoConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+// Pool caches dialed connections by remote address
+type Pool struct{}
+
+// NewPool creates a pool dialing network
+func NewPool(network string, maxIdle int, idleTimeout time.Duration) *Pool {
+	return new(Pool)
+}
+
+// Get returns an idle connection to address, or dials a new one
+func (p *Pool) Get(address string) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
+// Put returns conn from Get to the pool
+func (p *Pool) Put(conn *TCPConn) error {
+	return errors.New("os not supported")
+}
+
+// Close closes the idle connections
+func (p *Pool) Close() error {
+	return nil
+}
+
+// DialReadOnly opens a receive-only connection capturing the flow between laddr and raddr
+func DialReadOnly(network string, laddr, raddr *net.TCPAddr) (*TCPConn, error) {
+	return nil, errors.New("os not supported")
+}
+
 func Listen(network, address string) (*TCPConn, error) {
 	return nil, errors.New("os not supported")
 }
+
+// InterfaceInfo describes a network interface considered for capturing
+type InterfaceInfo struct {
+	Name  string
+	Index int
+	MTU   int
+	Flags net.Flags
+	Addrs []net.Addr
+}
+
+// ListInterfaces returns the network interfaces considered for capturing
+func ListInterfaces() ([]InterfaceInfo, error) {
+	return nil, errors.New("os not supported")
+}
+
+// SendRST injects a single RST segment from laddr to raddr
+func SendRST(laddr, raddr *net.TCPAddr, seq uint32) error {
+	return errors.New("os not supported")
+}
+
+// CheckInterface verifies that raw capture works on the interface having localIP assigned
+func CheckInterface(localIP net.IP) error {
+	return errors.New("os not supported")
+}
+
+// RefreshInterfaces re-enumerates the network interfaces
+func RefreshInterfaces() error {
+	return errors.New("os not supported")
+}
@@ -1,11 +1,24 @@
 package tcpraw
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 //const testPortStream = "127.0.0.1:3456"
@@ -16,6 +29,12 @@ const portServerPacket = "[::]:3457"
 const portRemotePacket = "127.0.0.1:3457"
 
 func init() {
+	// fuzzing workers run in child processes, the servers are already up in the parent
+	for _, arg := range os.Args {
+		if strings.HasPrefix(arg, "-test.fuzzworker") {
+			return
+		}
+	}
 	startTCPServer()
 	startTCPRawServer()
 	go func() {
@@ -148,6 +167,211 @@ func TestDialToTCPPacket(t *testing.T) {
 	log.Println("complete")
 }
 
+func TestHijack(t *testing.T) {
+	tcpconn, err := net.Dial("tcp", portRemotePacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Hijack(tcpconn.(*net.TCPConn))
+	if err != nil {
+		tcpconn.Close()
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.WriteTo([]byte("abc"), tcpconn.RemoteAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != "abc" {
+		t.Fatal(string(buf[:n]), err)
+	}
+}
+
+func TestAcceptFunc(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:3458")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	rejected := make(chan net.Addr, 1)
+	if err := l.SetAcceptFunc(func(addr net.Addr) bool {
+		rejected <- addr
+		return false
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp", "127.0.0.1:3458")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if addr := <-rejected; addr.String() != c.LocalAddr().String() {
+		t.Fatalf("rejected %v, expect %v", addr, c.LocalAddr())
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("rejected client not closed:", err)
+	}
+
+	conn, _ := newLoopbackConn()
+	defer conn.Close()
+	if conn.SetAcceptFunc(nil) == nil {
+		t.Fatal("accept func set on a dialed connection")
+	}
+}
+
+func TestHoldPending(t *testing.T) {
+	conn := newTCPConn()
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	for i := 0; i < pendingSize+2; i++ {
+		if conn.hold(message{bts: []byte{byte(i)}, addr: addr}) {
+			t.Fatal("held payload delivered before accepting")
+		}
+	}
+	if n := len(conn.flowTable[addr.String()].pending); n != pendingSize {
+		t.Fatalf("%v payloads held, expect %v", n, pendingSize)
+	}
+
+
+	// the expired payloads are dropped
+	conn.flowTable[addr.String()].pendingTs = time.Now().Add(-2 * pendingTimeout)
+	conn.hold(message{bts: []byte{0}, addr: addr})
+	if n := len(conn.flowTable[addr.String()].pending); n != 1 || conn.pending != 1 {
+		t.Fatalf("%v payloads of %v bytes held after expiry", n, conn.pending)
+	}
+
+	// the payloads held in all flows are bounded
+	big := make([]byte, maxPacketSize)
+	for port := 2000; port < 2100; port++ {
+		conn.hold(message{bts: big, addr: &net.TCPAddr{IP: addr.IP, Port: port}})
+	}
+	if conn.pending > pendingBytes {
+		t.Fatalf("%v bytes held", conn.pending)
+	}
+
+	// nothing is held for a rejected client
+	conn.lockflow(addr, func(e *tcpFlow) {
+		conn.dropPending(e)
+		e.rejected = true
+	})
+	conn.hold(message{bts: []byte{0}, addr: addr})
+	if n := len(conn.flowTable[addr.String()].pending); n != 0 {
+		t.Fatalf("%v payloads held for a rejected client", n)
+	}
+
+	conn.lockflow(addr, func(e *tcpFlow) { e.conn = new(net.TCPConn) })
+	if !conn.hold(message{bts: []byte{0}, addr: addr}) {
+		t.Fatal("payload held after accepting")
+	}
+}
+
+func TestDialParallel(t *testing.T) {
+	const n = 32
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := Dial("tcp", portRemotePacket)
+			if err != nil {
+				errs <- err
+				return
+			}
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// TestRebindClose is meant to run with -race, Rebind mustn't start draining
+// a new kernel socket while Close waits for them.
+func TestRebindClose(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		conn, err := Dial("tcp", portRemotePacket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcpconn := conn.client()
+		for i := 0; i < 100 && !discarding(tcpconn); i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if !discarding(tcpconn) {
+			t.Fatal("kernel socket of a dialed connection not drained")
+		}
+		done := make(chan error)
+		go func() { done <- conn.Rebind() }()
+		conn.Close()
+		if discarding(tcpconn) {
+			t.Fatal("kernel socket drained after Close")
+		}
+		<-done
+		if c := conn.client(); c != nil && discarding(c) {
+			t.Fatal("rebound socket drained after Close")
+		}
+	}
+
+	// a discard goroutine slow to see its socket closed holds Close
+	conn, err := Dial("tcp", portRemotePacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	released := make(chan struct{})
+	conn.wg.Add(1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(released)
+		conn.wg.Done()
+	}()
+	conn.Close()
+	select {
+	case <-released:
+	default:
+		t.Fatal("Close returned before the discard goroutines")
+	}
+}
+
+// discarding tells whether a discard goroutine is draining tcpconn, the
+// goroutine stack holds it as argument of the reads
+func discarding(tcpconn *net.TCPConn) bool {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "(*TCPConn).discard.func") && strings.Contains(g, fmt.Sprintf("(%p", tcpconn)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRebindRestore(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Dial("tcp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	l.Close()
+
+	port := conn.localPort()
+	if err := conn.Rebind(); err == nil {
+		t.Fatal("rebound to a closed port")
+	}
+	if p := conn.localPort(); p != port {
+		t.Fatalf("local port %v after failed rebind, expect %v", p, port)
+	}
+}
+
 func TestSettings(t *testing.T) {
 	conn, err := Dial("tcp", portRemotePacket)
 	if err != nil {
@@ -165,6 +389,134 @@ func TestSettings(t *testing.T) {
 	}
 }
 
+func TestDialUnknownNetwork(t *testing.T) {
+	if _, err := Dial("udp", portRemotePacket); err == nil {
+		t.Fatal("expected error on udp network")
+	}
+	// resolving fails for Dial, resolved addresses reach the family check
+	for _, c := range []struct {
+		network string
+		ip      string
+	}{{"tcp6", "127.0.0.1"}, {"tcp4", "::1"}} {
+		_, err := DialAddr(c.network, nil, &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 3457})
+		var ae *net.AddrError
+		if !errors.As(err, &ae) || ae.Err != "mismatched address family" {
+			t.Fatalf("%v to %v: expected mismatched address family, got %v", c.network, c.ip, err)
+		}
+	}
+}
+
+func TestDialErrorStage(t *testing.T) {
+	_, err := Dial("tcp", "invalid.invalid:3457")
+	var de *DialError
+	if !errors.As(err, &de) || de.Stage != StageResolve {
+		t.Fatalf("expected DialError at stage %q, got %v", StageResolve, err)
+	}
+}
+
+func TestSendRSTPorts(t *testing.T) {
+	lo := net.ParseIP("127.0.0.1")
+	for _, port := range []int{0, 0x10000} {
+		err := SendRST(&net.TCPAddr{IP: lo, Port: 4000}, &net.TCPAddr{IP: lo, Port: port}, 0)
+		var ae *net.AddrError
+		if !errors.As(err, &ae) {
+			t.Fatalf("port %v: unexpected %v", port, err)
+		}
+	}
+}
+
+func TestUnwrapSeq(t *testing.T) {
+	cases := []struct {
+		prev   uint64
+		v      uint32
+		expect uint64
+	}{
+		{0, 1000, 1000},
+		{1000, 2000, 2000},
+		{2000, 1500, 1500},
+		{0xfffffff0, 0x10, 0x100000010},
+		{0x100000010, 0xfffffff0, 0xfffffff0},
+		{0x1fffffff0, 0x20, 0x200000020},
+	}
+	for _, c := range cases {
+		if got := unwrapSeq(c.prev, c.v); got != c.expect {
+			t.Fatalf("unwrapSeq(%#x, %#x) = %#x, expect %#x", c.prev, c.v, got, c.expect)
+		}
+	}
+}
+
+func TestAddrIP(t *testing.T) {
+	v4 := &net.IPNet{IP: net.ParseIP("192.168.1.1"), Mask: net.CIDRMask(24, 32)}
+	v6 := &net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)}
+	cases := []struct {
+		addr    net.Addr
+		network string
+		usable  bool
+	}{
+		{v4, "tcp", true},
+		{v4, "tcp4", true},
+		{v4, "tcp6", false},
+		{v6, "tcp", true},
+		{v6, "tcp4", false},
+		{&net.IPNet{}, "tcp", false},
+		{&net.IPNet{IP: net.IPv6unspecified}, "tcp", false},
+		{&net.IPAddr{IP: v4.IP}, "tcp", false},
+	}
+	for _, c := range cases {
+		if got := addrIP(c.addr, c.network) != nil; got != c.usable {
+			t.Fatalf("addrIP(%v, %v) usable = %v, expect %v", c.addr, c.network, got, c.usable)
+		}
+	}
+}
+
+func TestParseICMPError(t *testing.T) {
+	// fragmentation needed with MTU 1400, quoting 10.0.0.1:4000 -> 10.0.0.2:443
+	b := []byte{3, 4, 0, 0, 0, 0, 0x05, 0x78,
+		0x45, 0, 0, 40, 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2,
+		0x0f, 0xa0, 0x01, 0xbb, 0, 0, 0, 0}
+	e, port, ok := parseICMPError(b, true)
+	if !ok || port != 4000 || e.MTU != 1400 || e.Addr.String() != "10.0.0.2:443" {
+		t.Fatalf("unexpected %v %v %v", e, port, ok)
+	}
+
+	// echo reply is not an error
+	if _, _, ok := parseICMPError([]byte{0, 0, 0, 0, 0, 0, 0, 0}, true); ok {
+		t.Fatal("echo reply parsed as an error")
+	}
+}
+
+func TestAvailableInjectModes(t *testing.T) {
+	modes := AvailableInjectModes()
+	if len(modes) == 0 || modes[len(modes)-1] != InjectKernelTCP {
+		t.Fatalf("kernel TCP missing from %v", modes)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	expect := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, d := range expect {
+		if got := p.backoff(i); got != d {
+			t.Fatalf("backoff(%v) = %v, expect %v", i, got, d)
+		}
+	}
+	if got := (RetryPolicy{}).backoff(0); got != defaultMinBackoff {
+		t.Fatalf("default backoff = %v, expect %v", got, defaultMinBackoff)
+	}
+}
+
+func TestFatal(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: errTimeout}
+	for _, err := range []error{nil, errTimeout, timeout, io.ErrShortBuffer, ErrReadLimit} {
+		if fatal(err) {
+			t.Fatalf("%v taken as fatal", err)
+		}
+	}
+	if !fatal(ErrClosed) {
+		t.Fatal("ErrClosed not fatal")
+	}
+}
+
 func BenchmarkEcho(b *testing.B) {
 	conn, err := Dial("tcp", portRemotePacket)
 	if err != nil {
@@ -191,3 +543,941 @@ func BenchmarkEcho(b *testing.B) {
 		}
 	}
 }
+
+// loopbackHandle is an in-memory packetHandle, every segment written
+// is delivered back to the reader of the same handle.
+type loopbackHandle struct {
+	ip    net.IP
+	ch    chan []byte
+	close chan struct{}
+}
+
+func newLoopbackHandle(ip net.IP) *loopbackHandle {
+	return &loopbackHandle{ip: ip, ch: make(chan []byte, 128), close: make(chan struct{})}
+}
+
+func (h *loopbackHandle) ReadMsgIP(b, oob []byte) (n, oobn, flags int, addr *net.IPAddr, err error) {
+	select {
+	case bts := <-h.ch:
+		return copy(b, bts), 0, 0, &net.IPAddr{IP: h.ip}, nil
+	case <-h.close:
+		return 0, 0, 0, nil, io.EOF
+	}
+}
+
+func (h *loopbackHandle) WriteMsgIP(b, oob []byte, addr *net.IPAddr) (n, oobn int, err error) {
+	bts := make([]byte, len(b))
+	copy(bts, b)
+	select {
+	case h.ch <- bts:
+		return len(b), len(oob), nil
+	case <-h.close:
+		return 0, 0, io.EOF
+	}
+}
+
+func (h *loopbackHandle) LocalAddr() net.Addr { return &net.IPAddr{IP: h.ip} }
+func (h *loopbackHandle) Close() error        { close(h.close); return nil }
+
+// newLoopbackConn creates a connection talking to itself over a loopbackHandle,
+// it exercises the serialization and capture path without privileges.
+func newLoopbackConn() (*TCPConn, *net.TCPAddr) {
+	const port = 4000
+	handle := newLoopbackHandle(net.IPv6loopback)
+	addr := &net.TCPAddr{IP: net.IPv6loopback, Port: port}
+
+	conn := newTCPConn()
+	conn.lport = port
+	conn.rport = port
+	conn.raddr = addr
+	conn.lockflow(addr, func(e *tcpFlow) {
+		e.conn = new(net.TCPConn) // placeholder to mark the flow established
+		e.handle = handle
+	})
+	go conn.captureFlow(handle)
+	go func() {
+		<-conn.die
+		handle.Close()
+	}()
+	return conn, addr
+}
+
+func TestBuildPacket(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+
+	bts, err := conn.BuildPacket([]byte("abc"), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(bts, layers.LayerTypeTCP, gopacket.Default)
+	tcp, ok := packet.TransportLayer().(*layers.TCP)
+	if !ok {
+		t.Fatal("not a TCP segment")
+	}
+	if int(tcp.DstPort) != addr.Port || !tcp.PSH || string(tcp.Payload) != "abc" {
+		t.Fatalf("unexpected segment %v", tcp)
+	}
+	if seq, _, _ := conn.Sequence(addr); seq != 0 {
+		t.Fatalf("BuildPacket advanced seq to %v", seq)
+	}
+}
+
+func TestSetPorts(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+	handle := conn.flowTable[addr.String()].handle.(*loopbackHandle)
+	stale, err := conn.BuildPacket([]byte("old"), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.SetPorts(4001, 4001); err != nil {
+		t.Fatal(err)
+	}
+	naddr := &net.TCPAddr{IP: addr.IP, Port: 4001}
+	if conn.flowTable[addr.String()] != nil || conn.flowTable[naddr.String()] == nil {
+		t.Fatal("flow not moved to the new ports")
+	}
+	if conn.remoteAddr().String() != naddr.String() {
+		t.Fatal("unexpected remote address", conn.remoteAddr())
+	}
+
+	bts, err := conn.BuildPacket([]byte("new"), naddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := gopacket.NewPacket(bts, layers.LayerTypeTCP, gopacket.Default).TransportLayer().(*layers.TCP)
+	if tcp.SrcPort != 4001 || tcp.DstPort != 4001 {
+		t.Fatalf("unexpected ports %v -> %v", tcp.SrcPort, tcp.DstPort)
+	}
+
+	// a segment to the old port captured first is dropped
+	handle.ch <- stale
+	if _, err := conn.WriteTo([]byte("new"), naddr); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "new" || from.String() != naddr.String() {
+		t.Fatalf("unexpected datagram %q from %v", buf[:n], from)
+	}
+}
+
+func TestBuildPacketState(t *testing.T) {
+	conn := newTCPConn()
+	var ids int
+	conn.SetIPID(func() uint16 { ids++; return 7 })
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	conn.lockflow(addr, func(e *tcpFlow) { e.tcpHeader.Window = 1234 })
+
+	bts, err := conn.BuildPacket([]byte("abc"), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(bts, layers.LayerTypeIPv4, gopacket.Default)
+	if ip, ok := packet.NetworkLayer().(*layers.IPv4); !ok || ip.Id != 0 {
+		t.Fatal("unexpected IPv4 header", ip)
+	}
+	e := conn.flowTable[addr.String()]
+	if ids != 0 || e.tcpHeader.PSH || e.tcpHeader.Window != 1234 || e.tcpHeader.DstPort != 0 {
+		t.Fatalf("flow changed by BuildPacket, %v ids taken, header %+v", ids, e.tcpHeader)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+	s1, cancel := conn.Subscribe(4)
+	s2, _ := conn.Subscribe(4)
+	slow, _ := conn.Subscribe(1)
+	unbuffered, _ := conn.Subscribe(-1)
+	if cap(unbuffered) != 0 {
+		t.Fatal("negative buffer not taken as 0")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	for _, s := range []string{"a", "b", "c"} {
+		if _, err := conn.WriteTo([]byte(s), addr); err != nil {
+			t.Fatal(err)
+		}
+		// the subscribers are offered a datagram before it's queued for reading
+		if n, _, err := conn.ReadFrom(buf); err != nil || string(buf[:n]) != s {
+			t.Fatal(string(buf[:n]), err)
+		}
+	}
+
+	// every subscriber gets its own copy
+	for _, ch := range []<-chan Datagram{s1, s2} {
+		for _, s := range []string{"a", "b", "c"} {
+			d := <-ch
+			if string(d.Payload) != s || d.Addr.String() != addr.String() {
+				t.Fatalf("unexpected datagram %q from %v", d.Payload, d.Addr)
+			}
+			d.Payload[0] = 'x'
+		}
+	}
+	// the slow subscriber misses the datagrams beyond its buffer only
+	if len(slow) != 1 || string((<-slow).Payload) != "a" || len(unbuffered) != 0 {
+		t.Fatal("unexpected datagrams for the slow subscribers")
+	}
+
+	cancel()
+	if _, ok := <-s1; ok {
+		t.Fatal("channel open after cancel")
+	}
+	conn.Close()
+	for _, ch := range []<-chan Datagram{s2, slow, unbuffered} {
+		if _, ok := <-ch; ok {
+			t.Fatal("channel open after Close")
+		}
+	}
+	ch, _ := conn.Subscribe(1)
+	if _, ok := <-ch; ok {
+		t.Fatal("subscribed to a closed connection")
+	}
+}
+
+func TestPackets(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+	ch := conn.Packets()
+	if conn.Packets() != ch {
+		t.Fatal("Packets returned another channel")
+	}
+
+	if _, err := conn.WriteTo([]byte("abc"), addr); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-ch:
+		if string(d.Payload) != "abc" || d.Addr.String() != addr.String() {
+			t.Fatalf("unexpected datagram %q from %v", d.Payload, d.Addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no datagram delivered")
+	}
+
+	conn.Close()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("datagram delivered after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel open after Close")
+	}
+}
+
+func TestReadBatch(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+	ps := [][]byte{make([]byte, 16), make([]byte, 16), make([]byte, 16), make([]byte, 16)}
+	ns := make([]int, len(ps))
+	addrs := make([]net.Addr, len(ps))
+	if _, err := conn.ReadBatch(ps, ns[:1], addrs); err == nil {
+		t.Fatal("short metadata slices accepted")
+	}
+
+	// nothing to read, the deadline fires
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	count, err := conn.ReadBatch(ps, ns, addrs)
+	if ne, ok := err.(net.Error); count != 0 || !ok || !ne.Timeout() {
+		t.Fatal("unexpected result on deadline", count, err)
+	}
+
+	// the batch returns the datagrams available without waiting to fill
+	for _, s := range []string{"a", "b", "c"} {
+		if _, err := conn.WriteTo([]byte(s), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100 && conn.QueueStats().Len < 3; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	count, err = conn.ReadBatch(ps, ns, addrs)
+	if err != nil || count != 3 || time.Since(start) > time.Second {
+		t.Fatal("unexpected batch", count, err, time.Since(start))
+	}
+	for i, s := range []string{"a", "b", "c"} {
+		if string(ps[i][:ns[i]]) != s || addrs[i].String() != addr.String() {
+			t.Fatalf("unexpected datagram %q from %v", ps[i][:ns[i]], addrs[i])
+		}
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	var oe *net.OpError
+	if _, err := conn.WriteTo([]byte("abc"), addr); !errors.As(err, &oe) || oe.Err != errWriteShutdown {
+		t.Fatal("write accepted after CloseWrite", err)
+	}
+
+	// closing takes over the shutdown
+	conn.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := conn.WriteTo([]byte("abc"), addr); !errors.Is(err, ErrClosed) {
+			t.Fatal("unexpected write error after Close", err)
+		}
+	}
+}
+
+func TestMaxInflight(t *testing.T) {
+	// nothing is captured, the writes are never acknowledged
+	conn := newTCPConn()
+	defer conn.Close()
+	handle := newLoopbackHandle(net.IPv6loopback)
+	defer handle.Close()
+	addr := &net.TCPAddr{IP: net.IPv6loopback, Port: 4000}
+	conn.lockflow(addr, func(e *tcpFlow) {
+		e.conn = new(net.TCPConn)
+		e.handle = handle
+	})
+	conn.SetMaxInflight(5)
+
+	// a segment is always allowed on an idle flow
+	if _, err := conn.WriteTo([]byte("abcd"), addr); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.WriteTo([]byte("abcd"), addr); n != 0 || !errors.Is(err, errTimeout) {
+		t.Fatal("write beyond the window not timed out", n, err)
+	}
+
+	conn.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.WriteTo([]byte("abcd"), addr)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatal("write beyond the window not blocked", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.SetMaxInflight(0)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked write not resumed")
+	}
+}
+
+func TestDialReadOnly(t *testing.T) {
+	laddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4100}
+	raddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4101}
+	conn, err := DialReadOnly("tcp4", laddr, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.LocalAddr().String() != laddr.String() {
+		t.Fatal("unexpected local address", conn.LocalAddr())
+	}
+
+	var oe *net.OpError
+	if _, err := conn.WriteTo([]byte("abc"), raddr); !errors.As(err, &oe) || oe.Err != ErrReadOnly {
+		t.Fatal("WriteTo accepted on a read-only connection", err)
+	}
+	if _, err := conn.WriteMsg([]byte("abc"), SendMeta{TTL: 8}, raddr); !errors.As(err, &oe) || oe.Err != ErrReadOnly {
+		t.Fatal("WriteMsg accepted on a read-only connection", err)
+	}
+	if err := conn.SetWriteQueue(1); err != ErrReadOnly {
+		t.Fatal("write queue set on a read-only connection", err)
+	}
+	if err := conn.CloseWrite(); err != ErrReadOnly {
+		t.Fatal("CloseWrite accepted on a read-only connection", err)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+
+	for _, size := range []int{0, 64, -1} {
+		if err := conn.SetBufferPool(size); err != nil {
+			t.Fatal(err)
+		}
+		// the packets returned mustn't alias the recycled buffers
+		first, err := conn.BuildPacket([]byte("abc"), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := append([]byte(nil), first...)
+		if _, err := conn.BuildPacket(make([]byte, 100), addr); err != nil {
+			t.Fatal(err)
+		}
+		if string(first) != string(saved) {
+			t.Fatalf("packet overwritten with buffer size %v", size)
+		}
+	}
+
+	p := newBufferPool(64)
+	buf := p.get()
+	buf.PrependBytes(100)
+	p.put(buf)
+	if p.get() == buf {
+		t.Fatal("grown buffer recycled")
+	}
+}
+
+func TestUnfixedDataOffset(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+	conn.SetSerializeOptions(gopacket.SerializeOptions{ComputeChecksums: true})
+	conn.SetEchoTimestamps(true)
+	conn.lockflow(addr, func(e *tcpFlow) { e.tsSeen = time.Now() })
+
+	// the IPv6 packet starts at the TCP header, timestamps take 12 bytes
+	bts, err := conn.BuildPacket([]byte("abc"), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off := bts[12] >> 4; off != 8 {
+		t.Fatalf("data offset %v, expect 8", off)
+	}
+}
+
+func TestSetOptionsRange(t *testing.T) {
+	conn, _ := newLoopbackConn()
+	defer conn.Close()
+	if err := conn.SetOptions(&Options{DSCP: 64}); err == nil {
+		t.Fatal("DSCP 64 accepted")
+	}
+	if err := conn.SetOptions(&Options{DSCP: 63, TTL: 32}); err != nil {
+		t.Fatal(err)
+	}
+	if opts := conn.Options(); opts.DSCP != 63 || opts.TTL != 32 {
+		t.Fatalf("unexpected %+v", opts)
+	}
+}
+
+func TestSendMetaCheck(t *testing.T) {
+	if err := (SendMeta{DataOffset: 15, IPLength: 0xffff}).check(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []SendMeta{{Window: 0x10000}, {DataOffset: 16}, {DataOffset: -1}, {IPLength: 0x10000}} {
+		if m.check() == nil {
+			t.Fatalf("%+v accepted", m)
+		}
+	}
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	conn, _ := newLoopbackConn()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- conn.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := conn.WriteTo([]byte("abc"), conn.remoteAddr())
+	var oe *net.OpError
+	if !errors.As(err, &oe) || !errors.Is(err, ErrClosed) {
+		t.Fatalf("unexpected write error %#v", err)
+	}
+}
+
+// TestConcurrentReadWriteClose is meant to run with -race, it drives the
+// read, write and configuration paths concurrently and closes in the middle.
+func TestConcurrentReadWriteClose(t *testing.T) {
+	conn, addr := newLoopbackConn()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := conn.WriteTo([]byte("abc"), addr); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1024)
+			for {
+				if _, _, err := conn.ReadFrom(buf); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-conn.die:
+					return
+				default:
+				}
+				opts := conn.Options()
+				if err := conn.SetOptions(&opts); err != nil {
+					t.Error(err)
+					return
+				}
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				conn.Snapshot(addr)
+				conn.BytesSent()
+				conn.SetLogger(nil)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+}
+
+func TestQueueStats(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := conn.WriteTo([]byte("abc"), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for start := time.Now(); conn.QueueStats().Len < 3; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("datagrams not queued")
+		}
+	}
+	conn.ReadFrom(make([]byte, 1024))
+
+	stats := conn.QueueStats()
+	if stats.Len != 2 || stats.Cap != messageQueueSize || stats.HighWater != 3 {
+		t.Fatalf("unexpected %+v", stats)
+	}
+	if n := conn.Drain(); n != 2 || conn.QueueStats().Len != 0 {
+		t.Fatalf("drained %v, left %v", n, conn.QueueStats().Len)
+	}
+}
+
+// recordLogger keeps the last message logged at any level
+type recordLogger struct{ last string }
+
+func (l *recordLogger) Debugf(format string, v ...interface{}) { l.last = fmt.Sprintf(format, v...) }
+func (l *recordLogger) Warnf(format string, v ...interface{})  { l.last = fmt.Sprintf(format, v...) }
+func (l *recordLogger) Errorf(format string, v ...interface{}) { l.last = fmt.Sprintf(format, v...) }
+
+func TestWriteQueue(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+	if err := conn.SetWriteQueue(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetWriteQueue(4); err == nil {
+		t.Fatal("write queue set twice")
+	}
+
+	const count = 16
+	for i := 0; i < count; i++ {
+		if n, err := conn.WriteTo([]byte{byte(i)}, addr); n != 1 || err != nil {
+			t.Fatal(n, err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	for i := 0; i < count; i++ {
+		if n, _, err := conn.ReadFrom(buf); n != 1 || err != nil || buf[0] != byte(i) {
+			t.Fatal(n, err, buf[0])
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	if err := conn.SetWriteQueue(4); err != nil {
+		t.Fatal(err)
+	}
+	const count = 16
+	for i := 0; i < count; i++ {
+		if _, err := conn.WriteTo([]byte{byte(i)}, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := conn.BytesSent(); n != count {
+		t.Fatalf("%v bytes sent before shutdown, expect %v", n, count)
+	}
+	if _, err := conn.WriteTo([]byte("abc"), addr); err == nil {
+		t.Fatal("write after shutdown")
+	}
+
+	// a write in progress outlasting ctx
+	conn, _ = newLoopbackConn()
+	conn.writeLock.RLock()
+	time.AfterFunc(200*time.Millisecond, conn.writeLock.RUnlock)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := conn.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("expect deadline exceeded, got", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Fatalf("shutdown took %v past its context", elapsed)
+	}
+}
+
+func TestPool(t *testing.T) {
+	p := NewPool("tcp", 1, time.Hour)
+	defer p.Close()
+
+	// pretend the loopback connections were dialed by Get
+	c1, _ := newLoopbackConn()
+	c2, _ := newLoopbackConn()
+	p.keys[c1] = "a"
+	p.keys[c2] = "a"
+	if err := p.Put(c1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Put(c2); err != nil {
+		t.Fatal(err)
+	}
+	if healthy(c2) {
+		t.Fatal("connection beyond the pool size kept open")
+	}
+	if conn, err := p.Get("a"); conn != c1 || err != nil {
+		t.Fatal(conn, err)
+	}
+
+	// the datagrams of the previous user are discarded
+	c1.WriteTo([]byte("abc"), c1.remoteAddr())
+	for i := 0; i < 100 && c1.QueueStats().Len == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	p.Put(c1)
+	if n := c1.QueueStats().Len; n != 0 {
+		t.Fatalf("%v stale datagrams kept", n)
+	}
+
+	// the tunables of the previous user are reset
+	c1.SetReadLimit(10)
+	c1.SetMaxInflight(1000)
+	p.keys[c1] = "a"
+	p.Put(c1)
+	if opts := c1.Options(); opts.ReadLimit != 0 || opts.MaxInflight != 0 {
+		t.Fatalf("options kept %+v", opts)
+	}
+
+	// connections not from the pool are left intact
+	c4, _ := newLoopbackConn()
+	defer c4.Close()
+	c4.SetReadLimit(10)
+	if p.Put(c4) == nil || c4.Options().ReadLimit != 10 {
+		t.Fatal("foreign connection taken")
+	}
+
+	// half-closed and unresettable connections are closed
+	p.Get("a")
+	c1.CloseWrite()
+	p.Put(c1)
+	if !isClosed(c1) {
+		t.Fatal("half-closed connection pooled")
+	}
+	c5, _ := newLoopbackConn()
+	c5.SetWriteQueue(1)
+	p.keys[c5] = "a"
+	p.Put(c5)
+	if !isClosed(c5) {
+		t.Fatal("connection with a write queue pooled")
+	}
+
+	// expired connections are closed by the sweeper
+	p2 := NewPool("tcp", 1, 10*time.Millisecond)
+	defer p2.Close()
+	c3, _ := newLoopbackConn()
+	p2.keys[c3] = "a"
+	p2.Put(c3)
+	time.Sleep(100 * time.Millisecond)
+	p2.mu.Lock()
+	count := p2.count
+	p2.mu.Unlock()
+	if healthy(c3) || count != 0 {
+		t.Fatal("idle connection not evicted")
+	}
+}
+
+// isClosed tells whether Close has been called on conn
+func isClosed(conn *TCPConn) bool {
+	select {
+	case <-conn.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	conn := newTCPConn()
+	conn.logEvent(Event{Seq: 1}) // disabled
+	if len(conn.RecentEvents()) != 0 {
+		t.Fatal("event recorded while disabled")
+	}
+
+	conn.SetEventLog(3)
+	for seq := uint32(1); seq <= 5; seq++ {
+		conn.logEvent(Event{Seq: seq})
+	}
+	events := conn.RecentEvents()
+	if len(events) != 3 || events[0].Seq != 3 || events[2].Seq != 5 {
+		t.Fatalf("unexpected %v", events)
+	}
+}
+
+func TestTaggedLogger(t *testing.T) {
+	conn := newTCPConn()
+	l := new(recordLogger)
+	conn.SetLogger(l)
+	conn.log().Warnf("dropped %d", 1)
+	if l.last != "dropped 1" {
+		t.Fatalf("unexpected %q", l.last)
+	}
+	conn.SetTag("pool-7")
+	conn.log().Errorf("dropped %d", 2)
+	if l.last != "[pool-7] dropped 2" {
+		t.Fatalf("unexpected %q", l.last)
+	}
+	conn.SetTag("100%")
+	conn.log().Debugf("dropped %d", 3)
+	if l.last != "[100%] dropped 3" {
+		t.Fatalf("unexpected %q", l.last)
+	}
+}
+
+func TestReadFromContext(t *testing.T) {
+	conn, _ := newLoopbackConn()
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := conn.ReadFromContext(ctx, make([]byte, 1024)); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestCopyMessage(t *testing.T) {
+	packet := message{bts: []byte("abcd")}
+	if n, err := copyMessage(make([]byte, 4), packet); n != 4 || err != nil {
+		t.Fatal(n, err)
+	}
+	if n, err := copyMessage(make([]byte, 1), packet); n != 1 || err != io.ErrShortBuffer {
+		t.Fatal(n, err)
+	}
+	packet.truncated = true
+	if n, err := copyMessage(make([]byte, 4), packet); n != 4 || err != ErrReadLimit {
+		t.Fatal(n, err)
+	}
+}
+
+func TestDialerControl(t *testing.T) {
+	d := &Dialer{ReuseAddr: true, ReusePort: true}
+	lc := net.ListenConfig{Control: d.control}
+	l1, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+
+	// the port can be bound twice with SO_REUSEPORT on both sockets
+	l2, err := lc.Listen(context.Background(), "tcp", l1.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2.Close()
+}
+
+func TestQueueSeqsReuse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	d := &Dialer{ReuseAddr: true}
+	c, err := (&net.Dialer{Control: d.control}).Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	tcpconn := c.(*net.TCPConn)
+	if err := setTTL(tcpconn, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := d.queueSeqs(tcpconn); err == syscall.EPERM {
+		t.Skip("TCP repair mode requires CAP_NET_ADMIN")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := tcpconn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reuse int
+	raw.Control(func(fd uintptr) {
+		reuse, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR)
+	})
+	if err != nil || reuse == 0 {
+		t.Fatal("SO_REUSEADDR lost in repair mode", reuse, err)
+	}
+}
+
+func TestParseIPv6Control(t *testing.T) {
+	oob := appendControl(nil, syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 3)
+	if _, ok := parseIPv6Control(oob, syscall.IPV6_HOPLIMIT); ok {
+		t.Fatal("hop limit without IPV6_HOPLIMIT")
+	}
+	oob = appendControl(oob, syscall.IPPROTO_IPV6, syscall.IPV6_HOPLIMIT, 57)
+	oob = appendControl(oob, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, 0xb8)
+	if hops, ok := parseIPv6Control(oob, syscall.IPV6_HOPLIMIT); !ok || hops != 57 {
+		t.Fatal(hops, ok)
+	}
+	if tclass, ok := parseIPv6Control(oob, syscall.IPV6_TCLASS); !ok || tclass != 0xb8 {
+		t.Fatal(tclass, ok)
+	}
+	if drops, ok := parseDrops(oob); !ok || drops != 3 {
+		t.Fatal(drops, ok)
+	}
+}
+
+func TestHandshakeRetries(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close() // connections are refused from now on
+
+	var attempts int
+	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		attempts++
+		return nil
+	}}
+	d := &Dialer{HandshakeRetries: 2, HandshakeBackoff: time.Millisecond}
+	if _, err := d.handshake(context.Background(), &dialer, "tcp", addr); err == nil {
+		t.Fatal("expected connection refused")
+	}
+	if attempts != 3 {
+		t.Fatalf("%v attempts, expect 3", attempts)
+	}
+}
+
+func TestBindPortInRange(t *testing.T) {
+	// reserve two adjacent ports, the upper one is kept busy and the lower
+	// one is released for the bind
+	var l, free net.Listener
+	for i := 0; i < 100 && free == nil; i++ {
+		var err error
+		if l, err = net.Listen("tcp4", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		if free, err = net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", port-1)); err != nil {
+			l.Close()
+		}
+	}
+	if free == nil {
+		t.Skip("no two adjacent free ports")
+	}
+	defer l.Close()
+	free.Close()
+	busy := l.Addr().(*net.TCPAddr).Port
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	if _, err := bindPortInRange(fd, net.IPv4(127, 0, 0, 1), true, busy, busy); err != syscall.EADDRINUSE {
+		t.Fatalf("expected EADDRINUSE, got %v", err)
+	}
+	port, err := bindPortInRange(fd, net.IPv4(127, 0, 0, 1), true, busy-1, busy)
+	if err != nil || port != busy-1 {
+		t.Fatal(port, err)
+	}
+}
+
+func BenchmarkLoopback(b *testing.B) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+
+	buf := make([]byte, 1024)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		n, err := conn.WriteTo(buf, addr)
+		if err != nil {
+			b.Fatal(n, err)
+		}
+
+		if n, addr, err := conn.ReadFrom(buf); err != nil {
+			b.Fatal(n, addr, err)
+		}
+	}
+}
+
+func TestWriteNoHandle(t *testing.T) {
+	conn := newTCPConn()
+	defer conn.Close()
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+
+	n, err := conn.WriteTo([]byte("abc"), addr)
+	var oe *net.OpError
+	if n != 0 || !errors.As(err, &oe) || oe.Err != errNoHandle {
+		t.Fatalf("unexpected write result %v %#v", n, err)
+	}
+}
+
+func TestTTLReserved(t *testing.T) {
+	conn, addr := newLoopbackConn()
+	defer conn.Close()
+	conn.dropKernelACKs = true
+
+	if err := conn.SetOptions(&Options{TTL: 1}); err != errTTLReserved {
+		t.Fatal("TTL 1 accepted by SetOptions", err)
+	}
+	if _, err := conn.WriteMsg([]byte("abc"), SendMeta{TTL: 1}, addr); !errors.Is(err, errTTLReserved) {
+		t.Fatal("TTL 1 accepted by WriteMsg", err)
+	}
+	if _, err := conn.WriteMsg([]byte("abc"), SendMeta{TTL: 2}, addr); err != nil {
+		t.Fatal(err)
+	}
+}